@@ -0,0 +1,254 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+package aferofs
+
+import (
+	"io"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/spf13/afero"
+	"github.com/zesagata/go-nfs-client/nfs"
+)
+
+// File is an afero.File for a regular file or a directory on the export
+type File struct {
+	name string
+	flag int
+	v    *nfs.Target
+
+	// set for regular files
+	f *nfs.File
+
+	// set for directories
+	dir *nfs.DirReader
+
+	// serializes Read, Write and Seek, which share the offset of f
+	mu sync.Mutex
+}
+
+var _ afero.File = (*File)(nil)
+
+func (f *File) Name() string {
+	return f.name
+}
+
+func (f *File) Stat() (os.FileInfo, error) {
+	var (
+		fi  os.FileInfo
+		err error
+	)
+
+	if f.dir != nil {
+		fi, err = f.v.Stat(f.name)
+	} else {
+		fi, err = f.f.Stat()
+	}
+
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: f.name, Err: err}
+	}
+
+	return fi, nil
+}
+
+func (f *File) Read(p []byte) (int, error) {
+	if f.dir != nil {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: syscall.EISDIR}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.f.Read(p)
+}
+
+// ReadAt reads at off without moving the offset of Read and Write, and may be
+// called concurrently with any other method
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	if f.dir != nil {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: syscall.EISDIR}
+	}
+
+	return f.f.ReadAt(p, off)
+}
+
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	if f.dir != nil {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: syscall.EISDIR}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.f.Seek(offset, whence)
+}
+
+func (f *File) Write(p []byte) (int, error) {
+	if err := f.checkWritable(); err != nil {
+		return 0, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.f.Write(p)
+}
+
+// WriteAt writes at off without moving the offset of Read and Write, and may
+// be called concurrently with any other method
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+	if err := f.checkWritable(); err != nil {
+		return 0, err
+	}
+
+	if f.flag&os.O_APPEND != 0 {
+		return 0, &os.PathError{Op: "writeat", Path: f.name, Err: os.ErrInvalid}
+	}
+
+	return f.f.WriteAt(p, off)
+}
+
+func (f *File) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+// ReadFrom copies r to the file with pipelined WRITEs, see nfs.File.ReadFrom
+func (f *File) ReadFrom(r io.Reader) (int64, error) {
+	if err := f.checkWritable(); err != nil {
+		return 0, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.f.ReadFrom(r)
+}
+
+// WriteTo copies the file to w with pipelined READs, see nfs.File.WriteTo
+func (f *File) WriteTo(w io.Writer) (int64, error) {
+	if f.dir != nil {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: syscall.EISDIR}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.f.WriteTo(w)
+}
+
+func (f *File) Truncate(size int64) error {
+	if err := f.checkWritable(); err != nil {
+		return err
+	}
+
+	if err := f.f.Truncate(size); err != nil {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: err}
+	}
+
+	return nil
+}
+
+// Sync commits the data written to the file, see nfs.File.Sync
+func (f *File) Sync() error {
+	if f.f == nil {
+		return nil
+	}
+
+	if err := f.f.Sync(); err != nil {
+		return &os.PathError{Op: "sync", Path: f.name, Err: err}
+	}
+
+	return nil
+}
+
+// Close commits the file if it was opened for writing
+func (f *File) Close() error {
+	if f.f == nil || f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return nil
+	}
+
+	return f.f.Close()
+}
+
+// Readdir returns the attributes of the next count entries of the directory,
+// with the semantics of os.File.Readdir
+func (f *File) Readdir(count int) ([]os.FileInfo, error) {
+	entries, err := f.readdir("readdir", count, true)
+	infos := make([]os.FileInfo, len(entries))
+	for i, entry := range entries {
+		infos[i] = entry
+	}
+
+	return infos, err
+}
+
+// Readdirnames is like Readdir, but returns only the names of the entries, so
+// that their attributes need not be looked up if the server did not return
+// them
+func (f *File) Readdirnames(n int) ([]string, error) {
+	entries, err := f.readdir("readdirnames", n, false)
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.FileName
+	}
+
+	return names, err
+}
+
+// readdir returns the next count entries of the directory, without "." and
+// "..".  With resolve, their attributes are looked up if missing, and entries
+// removed in the meantime are left out.
+func (f *File) readdir(op string, count int, resolve bool) ([]*nfs.EntryPlus, error) {
+	if f.dir == nil {
+		return nil, &os.PathError{Op: op, Path: f.name, Err: syscall.ENOTDIR}
+	}
+
+	var entries []*nfs.EntryPlus
+	for count <= 0 || len(entries) < count {
+		entry, err := f.dir.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return entries, &os.PathError{Op: op, Path: f.name, Err: err}
+		}
+
+		if entry.FileName == "." || entry.FileName == ".." {
+			continue
+		}
+
+		if resolve {
+			err = f.dir.Resolve(entry)
+			if os.IsNotExist(err) {
+				continue
+			}
+
+			if err != nil {
+				return entries, &os.PathError{Op: op, Path: f.name, Err: err}
+			}
+		}
+
+		entries = append(entries, entry)
+	}
+
+	if count > 0 && len(entries) == 0 {
+		return nil, io.EOF
+	}
+
+	return entries, nil
+}
+
+func (f *File) checkWritable() error {
+	if f.dir != nil {
+		return &os.PathError{Op: "write", Path: f.name, Err: syscall.EISDIR}
+	}
+
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return &os.PathError{Op: "write", Path: f.name, Err: syscall.EBADF}
+	}
+
+	return nil
+}
@@ -0,0 +1,255 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Package aferofs adapts an nfs.Target to the afero.Fs interface, so code
+// written against afero can use an NFS export as its backend.
+package aferofs
+
+import (
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/zesagata/go-nfs-client/nfs"
+)
+
+// Fs is an afero.Fs backed by an NFS export.  Paths are relative to the root
+// of the export; a leading slash is ignored.
+type Fs struct {
+	v *nfs.Target
+}
+
+var (
+	_ afero.Fs         = (*Fs)(nil)
+	_ afero.Lstater    = (*Fs)(nil)
+	_ afero.Symlinker  = (*Fs)(nil)
+	_ afero.LinkReader = (*Fs)(nil)
+)
+
+// New returns an afero.Fs for the export of v
+func New(v *nfs.Target) *Fs {
+	return &Fs{v: v}
+}
+
+func (fsys *Fs) Name() string {
+	return "nfs"
+}
+
+// Create creates or truncates the named file, like os.Create
+func (fsys *Fs) Create(name string) (afero.File, error) {
+	return fsys.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// Open opens the named file or directory for reading, like os.Open
+func (fsys *Fs) Open(name string) (afero.File, error) {
+	return fsys.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// OpenFile opens the named file with the semantics of os.OpenFile, see
+// nfs.Target.OpenFile.  Directories can only be opened read-only.
+func (fsys *Fs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	fi, err := fsys.v.Stat(name)
+	if err == nil && fi.IsDir() {
+		switch {
+		case flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+		case flag&(os.O_WRONLY|os.O_RDWR) != 0:
+			return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+		}
+
+		d, err := fsys.v.OpenDir(name)
+		if err != nil {
+			return nil, &os.PathError{Op: "open", Path: name, Err: err}
+		}
+
+		return &File{name: name, dir: d, v: fsys.v}, nil
+	}
+
+	f, err := fsys.v.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	return &File{name: name, f: f, flag: flag, v: fsys.v}, nil
+}
+
+// Mkdir creates the named directory
+func (fsys *Fs) Mkdir(name string, perm os.FileMode) error {
+	if _, err := fsys.v.Mkdir(name, perm); err != nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+
+	return nil
+}
+
+// MkdirAll creates the named directory along with any missing parents, like
+// os.MkdirAll
+func (fsys *Fs) MkdirAll(p string, perm os.FileMode) error {
+	dir := ""
+	for _, name := range strings.Split(path.Clean("/"+p), "/")[1:] {
+		if name == "" {
+			continue
+		}
+
+		dir = path.Join(dir, name)
+		fi, err := fsys.v.Stat(dir)
+		if err == nil {
+			if !fi.IsDir() {
+				return &os.PathError{Op: "mkdir", Path: dir, Err: syscall.ENOTDIR}
+			}
+			continue
+		}
+
+		if !os.IsNotExist(err) {
+			return &os.PathError{Op: "mkdir", Path: dir, Err: err}
+		}
+
+		// another client may have created it in the meantime
+		if _, err = fsys.v.Mkdir(dir, perm); err != nil && !os.IsExist(err) {
+			return &os.PathError{Op: "mkdir", Path: dir, Err: err}
+		}
+	}
+
+	return nil
+}
+
+// Remove removes the named file or empty directory
+func (fsys *Fs) Remove(name string) error {
+	fi, err := fsys.v.Lstat(name)
+	if err == nil {
+		if fi.IsDir() {
+			err = fsys.v.RmDir(name)
+		} else {
+			err = fsys.v.Remove(name)
+		}
+	}
+
+	if err != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: err}
+	}
+
+	return nil
+}
+
+// RemoveAll removes the named path and any children it contains.  It returns
+// nil if the path does not exist.
+func (fsys *Fs) RemoveAll(name string) error {
+	fi, err := fsys.v.Lstat(name)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+	case fi.IsDir():
+		err = fsys.v.RemoveAll(name)
+	default:
+		err = fsys.v.Remove(name)
+	}
+
+	if err != nil {
+		return &os.PathError{Op: "removeall", Path: name, Err: err}
+	}
+
+	return nil
+}
+
+// Rename moves oldname to newname
+func (fsys *Fs) Rename(oldname, newname string) error {
+	if err := fsys.v.Rename(oldname, newname); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+
+	return nil
+}
+
+// Stat returns the attributes of the named path, following symlinks
+func (fsys *Fs) Stat(name string) (os.FileInfo, error) {
+	fi, err := fsys.v.Stat(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+
+	return fi, nil
+}
+
+// LstatIfPossible returns the attributes of the named path without following
+// a final symlink
+func (fsys *Fs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	fi, err := fsys.v.Lstat(name)
+	if err != nil {
+		return nil, true, &os.PathError{Op: "lstat", Path: name, Err: err}
+	}
+
+	return fi, true, nil
+}
+
+// SymlinkIfPossible creates newname as a symlink to oldname
+func (fsys *Fs) SymlinkIfPossible(oldname, newname string) error {
+	if err := fsys.v.Symlink(oldname, newname); err != nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: err}
+	}
+
+	return nil
+}
+
+// ReadlinkIfPossible returns the target of the named symlink
+func (fsys *Fs) ReadlinkIfPossible(name string) (string, error) {
+	target, err := fsys.v.Readlink(name)
+	if err != nil {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: err}
+	}
+
+	return target, nil
+}
+
+func (fsys *Fs) Chmod(name string, mode os.FileMode) error {
+	if err := fsys.v.Chmod(name, mode); err != nil {
+		return &os.PathError{Op: "chmod", Path: name, Err: err}
+	}
+
+	return nil
+}
+
+func (fsys *Fs) Chown(name string, uid, gid int) error {
+	if err := fsys.v.Chown(name, uid, gid); err != nil {
+		return &os.PathError{Op: "chown", Path: name, Err: err}
+	}
+
+	return nil
+}
+
+func (fsys *Fs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	if err := fsys.v.Chtimes(name, atime, mtime); err != nil {
+		return &os.PathError{Op: "chtimes", Path: name, Err: err}
+	}
+
+	return nil
+}
+
+var tempSeq uint32
+
+// TempFile creates a new file in dir, opened for reading and writing, with a
+// name built from pattern as by os.CreateTemp: a random string replaces the
+// last "*", or is appended if there is none.
+func (fsys *Fs) TempFile(dir, pattern string) (afero.File, error) {
+	prefix, suffix := pattern, ""
+	if i := strings.LastIndex(pattern, "*"); i >= 0 {
+		prefix, suffix = pattern[:i], pattern[i+1:]
+	}
+
+	for try := 0; ; try++ {
+		seq := atomic.AddUint32(&tempSeq, 1) + uint32(time.Now().UnixNano())
+		name := path.Join(dir, prefix+strconv.FormatUint(uint64(seq), 10)+suffix)
+
+		f, err := fsys.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) && try < 10000 {
+			continue
+		}
+
+		return f, err
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+package nfs_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/zesagata/go-nfs-client/nfs"
+	"github.com/zesagata/go-nfs-client/nfs/aferofs"
+)
+
+// The tests of aferofs live here rather than in its directory, see
+// NewFakeTarget.
+
+func TestAferoReadWriteFile(t *testing.T) {
+	fsys := aferofs.New(nfs.NewFakeTarget(t))
+
+	if err := fsys.MkdirAll("a/b", 0755); err != nil {
+		t.Fatalf("mkdirall: %s", err)
+	}
+
+	if err := afero.WriteFile(fsys, "a/b/f", []byte("hello"), 0644); err != nil {
+		t.Fatalf("writefile: %s", err)
+	}
+
+	// WriteFile truncates what was there
+	if err := afero.WriteFile(fsys, "a/b/f", []byte("hi"), 0644); err != nil {
+		t.Fatalf("writefile: %s", err)
+	}
+
+	data, err := afero.ReadFile(fsys, "a/b/f")
+	if err != nil || string(data) != "hi" {
+		t.Fatalf("readfile: %q, %v", data, err)
+	}
+
+	f, err := fsys.OpenFile("a/b/f", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("open for appending: %s", err)
+	}
+
+	f.WriteString("!")
+	if err = f.Close(); err != nil {
+		t.Fatalf("close: %s", err)
+	}
+
+	if data, _ = afero.ReadFile(fsys, "a/b/f"); string(data) != "hi!" {
+		t.Fatalf("after appending: expected %q, got %q", "hi!", data)
+	}
+
+	if _, err = fsys.OpenFile("a/b/f", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644); !os.IsExist(err) {
+		t.Fatalf("O_EXCL on an existing file: expected exist, got %v", err)
+	}
+
+	if _, err = afero.ReadFile(fsys, "a/missing"); !os.IsNotExist(err) {
+		t.Fatalf("readfile of a missing file: expected not exist, got %v", err)
+	}
+
+	// directories are opened with Open, but cannot be read
+	if _, err = afero.ReadFile(fsys, "a"); err == nil {
+		t.Fatalf("expected an error reading a directory as a file")
+	}
+}
+
+func TestAferoRename(t *testing.T) {
+	fsys := aferofs.New(nfs.NewFakeTarget(t))
+	afero.WriteFile(fsys, "f", []byte("f"), 0644)
+	fsys.Mkdir("d", 0755)
+
+	if err := fsys.Rename("f", "d/g"); err != nil {
+		t.Fatalf("rename: %s", err)
+	}
+
+	if _, err := fsys.Stat("f"); !os.IsNotExist(err) {
+		t.Fatalf("old name after rename: expected not exist, got %v", err)
+	}
+
+	if data, err := afero.ReadFile(fsys, "d/g"); err != nil || string(data) != "f" {
+		t.Fatalf("new name after rename: %q, %v", data, err)
+	}
+
+	err := fsys.Rename("missing", "d/h")
+	if lerr, ok := err.(*os.LinkError); !ok || !os.IsNotExist(lerr.Err) {
+		t.Fatalf("rename of a missing file: expected a not exist *os.LinkError, got %v", err)
+	}
+}
+
+func TestAferoWalk(t *testing.T) {
+	fsys := aferofs.New(nfs.NewFakeTarget(t))
+	fsys.MkdirAll("w/b/c", 0755)
+	afero.WriteFile(fsys, "w/z", []byte("z"), 0644)
+	afero.WriteFile(fsys, "w/b/y", []byte("yy"), 0644)
+	fsys.SymlinkIfPossible("z", "w/link")
+
+	tmp, err := afero.TempFile(fsys, "w/b/c", "tmp")
+	if err != nil {
+		t.Fatalf("tempfile: %s", err)
+	}
+	tmp.Close()
+
+	var walked []string
+	err = afero.Walk(fsys, "w", func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		walked = append(walked, p)
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("walk: %s", err)
+	}
+
+	expected := []string{"w", "w/b", "w/b/c", tmp.Name(), "w/b/y", "w/link", "w/z"}
+	if strings.Join(walked, " ") != strings.Join(expected, " ") {
+		t.Fatalf("walk: expected %v, got %v", expected, walked)
+	}
+
+	if !strings.HasPrefix(filepath.Base(tmp.Name()), "tmp") {
+		t.Fatalf("temp file name %s does not start with its pattern", tmp.Name())
+	}
+
+	if err = fsys.RemoveAll("w"); err != nil {
+		t.Fatalf("removeall: %s", err)
+	}
+
+	if _, err = fsys.Stat("w"); !os.IsNotExist(err) {
+		t.Fatalf("after removeall: expected not exist, got %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Package billyfs adapts an nfs.Target to the billy.Filesystem interface of
+// go-billy.  It is built on package aferofs, and shares its semantics.
+package billyfs
+
+import (
+	"os"
+	"path"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/helper/chroot"
+	"github.com/spf13/afero"
+	"github.com/zesagata/go-nfs-client/nfs"
+	"github.com/zesagata/go-nfs-client/nfs/aferofs"
+)
+
+// Fs is a billy.Filesystem backed by an NFS export.  Paths are relative to
+// the root of the export; a leading slash is ignored.
+type Fs struct {
+	fsys *aferofs.Fs
+}
+
+var (
+	_ billy.Filesystem = (*Fs)(nil)
+	_ billy.Capable    = (*Fs)(nil)
+)
+
+// New returns a billy.Filesystem for the export of v
+func New(v *nfs.Target) *Fs {
+	return &Fs{fsys: aferofs.New(v)}
+}
+
+// Create creates or truncates the named file, like os.Create
+func (fsys *Fs) Create(filename string) (billy.File, error) {
+	return wrap(fsys.fsys.Create(filename))
+}
+
+// Open opens the named file for reading, like os.Open
+func (fsys *Fs) Open(filename string) (billy.File, error) {
+	return wrap(fsys.fsys.Open(filename))
+}
+
+// OpenFile opens the named file with the semantics of os.OpenFile, see
+// aferofs.Fs.OpenFile
+func (fsys *Fs) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	return wrap(fsys.fsys.OpenFile(filename, flag, perm))
+}
+
+// Stat returns the attributes of the named path, following symlinks
+func (fsys *Fs) Stat(filename string) (os.FileInfo, error) {
+	return fsys.fsys.Stat(filename)
+}
+
+// Rename moves oldpath to newpath
+func (fsys *Fs) Rename(oldpath, newpath string) error {
+	return fsys.fsys.Rename(oldpath, newpath)
+}
+
+// Remove removes the named file or empty directory
+func (fsys *Fs) Remove(filename string) error {
+	return fsys.fsys.Remove(filename)
+}
+
+func (fsys *Fs) Join(elem ...string) string {
+	return path.Join(elem...)
+}
+
+// TempFile creates a new file in dir whose name begins with prefix, opened
+// for reading and writing
+func (fsys *Fs) TempFile(dir, prefix string) (billy.File, error) {
+	return wrap(fsys.fsys.TempFile(dir, prefix))
+}
+
+// ReadDir returns the attributes of the entries of the named directory,
+// sorted by name
+func (fsys *Fs) ReadDir(p string) ([]os.FileInfo, error) {
+	return afero.ReadDir(fsys.fsys, p)
+}
+
+// MkdirAll creates the named directory along with any missing parents
+func (fsys *Fs) MkdirAll(filename string, perm os.FileMode) error {
+	return fsys.fsys.MkdirAll(filename, perm)
+}
+
+// Lstat returns the attributes of the named path without following a final
+// symlink
+func (fsys *Fs) Lstat(filename string) (os.FileInfo, error) {
+	fi, _, err := fsys.fsys.LstatIfPossible(filename)
+	return fi, err
+}
+
+// Symlink creates link as a symlink to target
+func (fsys *Fs) Symlink(target, link string) error {
+	return fsys.fsys.SymlinkIfPossible(target, link)
+}
+
+// Readlink returns the target of the named symlink
+func (fsys *Fs) Readlink(link string) (string, error) {
+	return fsys.fsys.ReadlinkIfPossible(link)
+}
+
+// Chroot returns a billy.Filesystem rooted at the named directory
+func (fsys *Fs) Chroot(p string) (billy.Filesystem, error) {
+	return chroot.New(fsys, fsys.Join(fsys.Root(), p)), nil
+}
+
+// Root returns the root of the export, "/"
+func (fsys *Fs) Root() string {
+	return "/"
+}
+
+// Capabilities reports everything but locking: NFSv3 leaves locks to the NLM
+// protocol, which this package does not speak.
+func (fsys *Fs) Capabilities() billy.Capability {
+	return billy.DefaultCapabilities &^ billy.LockCapability
+}
+
+// File is a billy.File for a regular file on the export
+type File struct {
+	*aferofs.File
+}
+
+var _ billy.File = (*File)(nil)
+
+func wrap(f afero.File, err error) (billy.File, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	return &File{File: f.(*aferofs.File)}, nil
+}
+
+// Lock returns billy.ErrNotSupported, as Capabilities reports; see
+// Fs.Capabilities
+func (f *File) Lock() error {
+	return billy.ErrNotSupported
+}
+
+// Unlock returns billy.ErrNotSupported, see Lock
+func (f *File) Unlock() error {
+	return billy.ErrNotSupported
+}
@@ -0,0 +1,91 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+package nfs_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/zesagata/go-nfs-client/nfs"
+	"github.com/zesagata/go-nfs-client/nfs/billyfs"
+)
+
+// The tests of billyfs live here rather than in its directory, see
+// NewFakeTarget.
+
+func TestBilly(t *testing.T) {
+	fsys := billyfs.New(nfs.NewFakeTarget(t))
+
+	if err := fsys.MkdirAll("repo/objects", 0755); err != nil {
+		t.Fatalf("mkdirall: %s", err)
+	}
+
+	if err := util.WriteFile(fsys, "repo/HEAD", []byte("ref: main\n"), 0644); err != nil {
+		t.Fatalf("writefile: %s", err)
+	}
+
+	repo, err := fsys.Chroot("repo")
+	if err != nil {
+		t.Fatalf("chroot: %s", err)
+	}
+
+	if data, err := util.ReadFile(repo, "HEAD"); err != nil || string(data) != "ref: main\n" {
+		t.Fatalf("readfile in a chroot: %q, %v", data, err)
+	}
+
+	f, err := repo.TempFile("objects", "pack")
+	if err != nil {
+		t.Fatalf("tempfile: %s", err)
+	}
+
+	f.Write([]byte("pack"))
+	if err = f.Close(); err != nil {
+		t.Fatalf("close: %s", err)
+	}
+
+	if err = repo.Rename(f.Name(), "objects/pack-1"); err != nil {
+		t.Fatalf("rename: %s", err)
+	}
+
+	infos, err := fsys.ReadDir("repo")
+	if err != nil || len(infos) != 2 || infos[0].Name() != "HEAD" || !infos[1].IsDir() {
+		t.Fatalf("readdir: %v, %v", infos, err)
+	}
+
+	if err = repo.Symlink("objects/pack-1", "latest"); err != nil {
+		t.Fatalf("symlink: %s", err)
+	}
+
+	if fi, err := fsys.Lstat("repo/latest"); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("lstat of a symlink: %v, %v", fi, err)
+	}
+
+	if target, err := repo.Readlink("latest"); err != nil || target != "objects/pack-1" {
+		t.Fatalf("readlink: %q, %v", target, err)
+	}
+
+	// no locking over NFSv3
+	if billy.CapabilityCheck(fsys, billy.LockCapability) {
+		t.Fatalf("expected no lock capability")
+	}
+
+	f, err = fsys.Open("repo/HEAD")
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	defer f.Close()
+
+	if err = f.Lock(); err != billy.ErrNotSupported {
+		t.Fatalf("lock: expected billy.ErrNotSupported, got %v", err)
+	}
+
+	if !billy.CapabilityCheck(fsys, billy.ReadAndWriteCapability|billy.TruncateCapability) {
+		t.Fatalf("expected read, write and truncate capabilities")
+	}
+
+	if _, err = fsys.Open("repo/missing"); !os.IsNotExist(err) {
+		t.Fatalf("open of a missing file: expected not exist, got %v", err)
+	}
+}
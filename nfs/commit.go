@@ -0,0 +1,194 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+package nfs
+
+import (
+	"context"
+	"io"
+
+	"github.com/zesagata/go-nfs-client/nfs/rpc"
+	"github.com/zesagata/go-nfs-client/nfs/util"
+	"github.com/zesagata/go-nfs-client/nfs/xdr"
+)
+
+// StableHow is how far a WRITE must get to stable storage before the server
+// replies, stable_how in RFC 1813.
+type StableHow uint32
+
+const (
+	// Unstable writes may be cached by the server until a COMMIT
+	Unstable StableHow = iota
+
+	// DataSync writes are on stable storage, but not necessarily the
+	// metadata needed to find them
+	DataSync
+
+	// FileSync writes are on stable storage along with all metadata
+	FileSync
+)
+
+// maxUncommitted is how much unstably written data a File keeps for
+// re-sending before it commits on its own
+const maxUncommitted = 64 * 1024 * 1024
+
+// uncommitted is data written UNSTABLE that the server may still lose
+type uncommitted struct {
+	offset uint64
+	data   []byte
+
+	// write verifier of the WRITE reply
+	verf uint64
+}
+
+// SetStability sets how writes through f are sent.  The default is FileSync,
+// which is safe but slow on most servers.  With Unstable or DataSync, f keeps
+// a copy of the data the server has not committed, and Sync and Close COMMIT
+// it.  If the write verifier changed in the meantime, the server has
+// rebooted and may have lost the data, so it is written again.
+func (f *File) SetStability(how StableHow) {
+	f.stable = how
+}
+
+// Sync commits the data written through f to stable storage, re-sending it
+// if the server lost it
+func (f *File) Sync() error {
+	return f.SyncContext(context.Background())
+}
+
+// SyncContext is Sync with a context
+func (f *File) SyncContext(ctx context.Context) error {
+	if err := f.flushWrites(ctx); err != nil {
+		return err
+	}
+
+	return f.commitPending(ctx)
+}
+
+// commitPending commits the data tracked so far, without waiting for the data
+// written behind, whose WRITEs may themselves be committing
+func (f *File) commitPending(ctx context.Context) error {
+	f.commitLock.Lock()
+	defer f.commitLock.Unlock()
+
+	f.pendingLock.Lock()
+	pending := f.pending
+	f.pending, f.pendingSize = nil, 0
+	f.pendingLock.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	verf, err := f.commit(ctx)
+	if err != nil {
+		f.requeue(pending)
+		return err
+	}
+
+	for i, w := range pending {
+		if w.verf == verf {
+			continue
+		}
+
+		util.Debugf("commit(%x): verifier changed from %x to %x, rewriting %d bytes at %d", f.fh, w.verf, verf, len(w.data), w.offset)
+		if err = f.rewrite(ctx, w); err != nil {
+			f.requeue(pending[i:])
+			return err
+		}
+	}
+
+	return nil
+}
+
+// track records data written at offset that the server has not committed,
+// and commits once too much is held.  It runs in the WRITEs sent behind as
+// well, so it must not wait for them as Sync does.
+func (f *File) track(ctx context.Context, offset uint64, data []byte, verf uint64) error {
+	w := uncommitted{
+		offset: offset,
+		data:   append([]byte(nil), data...),
+		verf:   verf,
+	}
+
+	f.pendingLock.Lock()
+	f.pending = append(f.pending, w)
+	f.pendingSize += len(data)
+	full := f.pendingSize >= maxUncommitted
+	f.pendingLock.Unlock()
+
+	if full {
+		return f.commitPending(ctx)
+	}
+
+	return nil
+}
+
+// requeue puts back writes that could not be committed, for the next Sync
+func (f *File) requeue(pending []uncommitted) {
+	f.pendingLock.Lock()
+	defer f.pendingLock.Unlock()
+
+	for _, w := range pending {
+		f.pendingSize += len(w.data)
+	}
+	f.pending = append(pending, f.pending...)
+}
+
+// rewrite sends w again as FILE_SYNC, so it needs no further COMMIT
+func (f *File) rewrite(ctx context.Context, w uncommitted) error {
+	for written := 0; written < len(w.data); {
+		count, _, _, err := f.writeChunk(ctx, w.data[written:], w.offset+uint64(written), FileSync)
+		if err != nil {
+			return err
+		}
+
+		if count == 0 {
+			return io.ErrShortWrite
+		}
+
+		written += int(count)
+	}
+
+	return nil
+}
+
+// commit asks the server to commit the whole file, and returns the write
+// verifier
+func (f *File) commit(ctx context.Context) (uint64, error) {
+	type CommitArg struct {
+		rpc.Header
+		FH     []byte
+		Offset uint64
+		Count  uint32
+	}
+
+	type CommitRes struct {
+		Wcc       WccData
+		WriteVerf uint64
+	}
+
+	res, err := f.call(ctx, &CommitArg{
+		Header: rpc.Header{
+			Rpcvers: 2,
+			Prog:    Nfs3Prog,
+			Vers:    Nfs3Vers,
+			Proc:    NFSProc3Commit,
+			Cred:    f.auth,
+			Verf:    rpc.AuthNull,
+		},
+		FH: f.fh,
+	})
+
+	if err != nil {
+		util.Debugf("commit(%x): %s", f.fh, err.Error())
+		return 0, err
+	}
+
+	commitres := &CommitRes{}
+	if err = xdr.Read(res, commitres); err != nil {
+		util.Errorf("commit(%x) failed to parse result: %s", f.fh, err.Error())
+		return 0, err
+	}
+
+	return commitres.WriteVerf, nil
+}
@@ -0,0 +1,144 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+package nfs
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zesagata/go-nfs-client/nfs/rpc"
+)
+
+// pooledConn is a connection of a Target, with the number of its calls in
+// flight
+type pooledConn struct {
+	*rpc.Client
+	outstanding int32
+
+	// the calls in flight, waited for before the connection is closed
+	calls sync.WaitGroup
+}
+
+// SetConnections makes v spread its calls over n connections to the NFS
+// service, like the nconnect mount option of Linux, so that they are not all
+// serialized on a single socket.  Each call goes on the connection with the
+// fewest calls in flight, and Files opened from v share its connections.
+// Lowering n stops sending calls on the extra connections, and closes them
+// once the calls in flight on them are done.
+func (v *Target) SetConnections(n int) error {
+	if n < 1 {
+		return errors.New("nfs: a target needs at least one connection")
+	}
+
+	v.connsLock.RLock()
+	missing := n - len(v.conns)
+	v.connsLock.RUnlock()
+
+	// dial without holding up the calls on the current connections
+	var added []*pooledConn
+	for i := 0; i < missing; i++ {
+		if v.dial == nil {
+			return errors.New("nfs: target cannot dial more connections")
+		}
+
+		client, err := v.dial()
+		if err != nil {
+			for _, p := range added {
+				p.Close()
+			}
+			return err
+		}
+
+		added = append(added, &pooledConn{Client: client})
+	}
+
+	v.connsLock.Lock()
+	for _, p := range added {
+		p.SetTimeout(v.timeout)
+		p.SetBackoff(v.backoff)
+	}
+	v.conns = append(v.conns, added...)
+
+	var removed []*pooledConn
+	if len(v.conns) > n {
+		removed = append(removed, v.conns[n:]...)
+		v.conns = v.conns[:n]
+	}
+	v.connsLock.Unlock()
+
+	// no call is started on the removed connections anymore
+	for _, p := range removed {
+		p.calls.Wait()
+		p.Close()
+	}
+
+	return nil
+}
+
+// conn returns the connection with the fewest calls in flight, and counts the
+// call about to be made on it until done
+func (v *Target) conn() *pooledConn {
+	v.connsLock.RLock()
+	defer v.connsLock.RUnlock()
+
+	// start from a different connection each time, to spread the calls
+	// evenly when they are all idle
+	start := int(atomic.AddUint32(&v.nextConn, 1))
+
+	var best *pooledConn
+	for i := range v.conns {
+		p := v.conns[(start+i)%len(v.conns)]
+		if best == nil || atomic.LoadInt32(&p.outstanding) < atomic.LoadInt32(&best.outstanding) {
+			best = p
+		}
+	}
+
+	atomic.AddInt32(&best.outstanding, 1)
+	best.calls.Add(1)
+	return best
+}
+
+func (p *pooledConn) done() {
+	atomic.AddInt32(&p.outstanding, -1)
+	p.calls.Done()
+}
+
+// SetTimeout bounds how long each call waits for its reply, on all the
+// connections of v.  0, the default, waits forever.
+func (v *Target) SetTimeout(d time.Duration) {
+	v.connsLock.Lock()
+	defer v.connsLock.Unlock()
+
+	v.timeout = d
+	for _, p := range v.conns {
+		p.SetTimeout(d)
+	}
+}
+
+// SetBackoff sets how the connections of v are redialed when they are lost.
+func (v *Target) SetBackoff(b rpc.Backoff) {
+	v.connsLock.Lock()
+	defer v.connsLock.Unlock()
+
+	v.backoff = b
+	for _, p := range v.conns {
+		p.SetBackoff(b)
+	}
+}
+
+// Close closes all the connections of v.
+func (v *Target) Close() error {
+	v.connsLock.Lock()
+	defer v.connsLock.Unlock()
+
+	var err error
+	for _, p := range v.conns {
+		if cerr := p.Close(); err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,101 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+package nfs
+
+import (
+	"context"
+	"io"
+)
+
+// copyWindow is the number of READs or WRITEs ReadFrom and WriteTo keep in
+// flight, unless read-ahead or write-behind is already on
+const copyWindow = 16
+
+// ReadFrom writes the data read from r until EOF at the current offset, and
+// returns the number of bytes written.  It implements io.ReaderFrom, so that
+// io.Copy to f sends WRITEs of WTPref bytes, several at a time, as with
+// SetWriteBehind.  Unless write-behind is on, those WRITEs are only in flight
+// during ReadFrom, and their errors are returned by it.
+func (f *File) ReadFrom(r io.Reader) (total int64, err error) {
+	ctx := context.Background()
+	size := f.writeSize()
+
+	// every Write has to find the end of the file
+	if f.appending {
+		return io.CopyBuffer(writerOnly{f}, r, make([]byte, size))
+	}
+
+	wb := f.wb
+	if wb == nil {
+		wb = newWriteBehind(f, copyWindow*int(size))
+		defer func() {
+			if ferr := wb.flush(ctx, f); err == nil {
+				err = ferr
+			}
+		}()
+	}
+
+	buf := make([]byte, size)
+	for {
+		n, rerr := io.ReadFull(r, buf)
+		if n > 0 {
+			m, werr := wb.write(ctx, f, buf[:n], f.curr)
+			f.curr += uint64(m)
+			total += int64(m)
+			if werr != nil {
+				return total, werr
+			}
+		}
+
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			return total, wb.flush(ctx, f)
+		}
+
+		if rerr != nil {
+			return total, rerr
+		}
+	}
+}
+
+// WriteTo writes the data from the current offset to the end of the file to
+// w, and returns the number of bytes written.  It implements io.WriterTo, so
+// that io.Copy from f keeps several READs in flight, as with SetReadAhead.
+func (f *File) WriteTo(w io.Writer) (int64, error) {
+	if f.ra == nil {
+		f.SetReadAhead(copyWindow)
+		defer f.SetReadAhead(0)
+	}
+
+	var (
+		total int64
+		buf   = make([]byte, f.readSize())
+	)
+
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			m, werr := w.Write(buf[:n])
+			total += int64(m)
+			if werr != nil {
+				return total, werr
+			}
+
+			if m < n {
+				return total, io.ErrShortWrite
+			}
+		}
+
+		if err == io.EOF {
+			return total, nil
+		}
+
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// writerOnly hides the ReadFrom of File from io.CopyBuffer
+type writerOnly struct {
+	io.Writer
+}
@@ -0,0 +1,555 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+package nfs
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync/atomic"
+
+	"github.com/zesagata/go-nfs-client/nfs/rpc"
+	"github.com/zesagata/go-nfs-client/nfs/util"
+	"github.com/zesagata/go-nfs-client/nfs/xdr"
+)
+
+// DirCookie is the position of a DirReader within its directory.  It can be
+// saved and handed to Target.ResumeDir to continue a listing later.
+type DirCookie struct {
+	Cookie     uint64
+	CookieVerf uint64
+
+	// Number of entries returned before this position.  If the server no
+	// longer accepts Cookie, the listing is restarted and this many entries
+	// are skipped.
+	Offset uint64
+}
+
+const (
+	// READDIR(PLUS) sizes used when the server does not report a preference
+	defaultDirCount = 512
+	defaultMaxCount = 4096
+
+	// largest reply size asked for when the server says it is too small, if
+	// neither FSINFO nor the transport set a lower limit
+	maxReadDirCount = 4 << 20
+)
+
+// SetReadDirSize overrides the sizes of READDIRPLUS requests, which default to
+// the DTPref and RTMax reported by FSINFO.  dircount limits the size of the
+// names and cookies in a reply, and maxcount the size of the whole reply
+// including attributes and handles.  A zero value restores the default.
+//
+// It is not safe to call SetReadDirSize while directories are being listed.
+func (v *Target) SetReadDirSize(dircount, maxcount uint32) {
+	v.dirCount = dircount
+	v.maxCount = maxcount
+}
+
+// readDirSize returns the dircount and maxcount of READDIRPLUS requests
+func (v *Target) readDirSize() (uint32, uint32) {
+	dircount, maxcount := v.dirCount, v.maxCount
+	if dircount == 0 && v.fsinfo != nil {
+		dircount = v.fsinfo.DTPref
+	}
+
+	if maxcount == 0 && v.fsinfo != nil {
+		maxcount = v.fsinfo.RTMax
+	}
+
+	if dircount == 0 {
+		dircount = defaultDirCount
+	}
+
+	if maxcount == 0 {
+		maxcount = defaultMaxCount
+	}
+
+	return dircount, maxcount
+}
+
+// maxReadDirSize returns the largest maxcount worth asking for when the server
+// says a reply is too small: no more than RTMax, nor than the transport can
+// carry
+func (v *Target) maxReadDirSize() uint32 {
+	limit := uint32(maxReadDirCount)
+	if v.fsinfo != nil && v.fsinfo.RTMax != 0 {
+		limit = min(limit, v.fsinfo.RTMax)
+	}
+
+	if payload := v.MaxPayload(); payload != 0 {
+		limit = min(limit, uint32(payload))
+	}
+
+	return limit
+}
+
+// DirReader lists a directory one page at a time, so that only a page of
+// entries is held in memory no matter how large the directory is.
+type DirReader struct {
+	v  *Target
+	fh []byte
+
+	// look up attributes and handles of entries
+	plus bool
+
+	// position after the last entry returned to the caller
+	pos DirCookie
+
+	// position to request the next page from
+	cookie     uint64
+	cookieVerf uint64
+
+	// sizes of the requests
+	dirCount, maxCount uint32
+
+	// entries fetched but not yet returned, and the number of entries still
+	// to be discarded after a restart
+	buf  []*EntryPlus
+	skip uint64
+
+	eof bool
+}
+
+// OpenDir returns a DirReader for the named directory.  Its entries carry
+// attributes and handles, like those returned by ReadDirPlus, unless the
+// server does not support READDIRPLUS; see DirReader.Resolve.
+func (v *Target) OpenDir(dir string) (*DirReader, error) {
+	return v.OpenDirContext(context.Background(), dir)
+}
+
+// OpenDirContext is OpenDir with a context
+func (v *Target) OpenDirContext(ctx context.Context, dir string) (*DirReader, error) {
+	return v.ResumeDirContext(ctx, dir, DirCookie{})
+}
+
+// ResumeDir returns a DirReader for the named directory that continues after
+// pos, as returned by DirReader.Checkpoint.
+func (v *Target) ResumeDir(dir string, pos DirCookie) (*DirReader, error) {
+	return v.ResumeDirContext(context.Background(), dir, pos)
+}
+
+// ResumeDirContext is ResumeDir with a context
+func (v *Target) ResumeDirContext(ctx context.Context, dir string, pos DirCookie) (*DirReader, error) {
+	_, fh, err := v.LookupContext(ctx, dir, FollowIntermediate|FollowLast)
+	if err != nil {
+		return nil, err
+	}
+
+	return v.openDir(fh, true, pos), nil
+}
+
+func (v *Target) openDir(fh []byte, plus bool, pos DirCookie) *DirReader {
+	dircount, maxcount := v.readDirSize()
+	return &DirReader{
+		v:          v,
+		fh:         fh,
+		plus:       plus,
+		pos:        pos,
+		cookie:     pos.Cookie,
+		cookieVerf: pos.CookieVerf,
+		dirCount:   dircount,
+		maxCount:   maxcount,
+	}
+}
+
+// Checkpoint returns the position after the last entry returned by Next or
+// ReadDir.
+func (d *DirReader) Checkpoint() DirCookie {
+	return d.pos
+}
+
+// Next returns the next entry of the directory, or io.EOF at its end.  The
+// "." and ".." entries are returned if the server lists them.
+func (d *DirReader) Next() (*EntryPlus, error) {
+	return d.NextContext(context.Background())
+}
+
+// NextContext is Next with a context
+func (d *DirReader) NextContext(ctx context.Context) (*EntryPlus, error) {
+	for len(d.buf) == 0 {
+		if d.eof {
+			return nil, io.EOF
+		}
+
+		if err := d.fill(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	entry := d.buf[0]
+	d.buf = d.buf[1:]
+
+	d.pos.Cookie = entry.Cookie
+	d.pos.CookieVerf = d.cookieVerf
+	d.pos.Offset++
+
+	return entry, nil
+}
+
+// ReadDir returns the next n entries of the directory, with the semantics of
+// os.File.ReadDir: if n > 0, at most n entries are returned and io.EOF at the
+// end of the directory; if n <= 0, all remaining entries are returned along
+// with a nil error at the end of the directory.
+func (d *DirReader) ReadDir(n int) ([]*EntryPlus, error) {
+	return d.ReadDirContext(context.Background(), n)
+}
+
+// ReadDirContext is ReadDir with a context
+func (d *DirReader) ReadDirContext(ctx context.Context, n int) ([]*EntryPlus, error) {
+	var entries []*EntryPlus
+	for n <= 0 || len(entries) < n {
+		entry, err := d.NextContext(ctx)
+		if err == io.EOF {
+			if n > 0 && len(entries) == 0 {
+				return nil, io.EOF
+			}
+			break
+		}
+
+		if err != nil {
+			return entries, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// fill fetches the next page of entries into buf
+func (d *DirReader) fill(ctx context.Context) error {
+	entries, cookieVerf, eof, err := d.page(ctx)
+	for limit := d.v.maxReadDirSize(); IsTooSmallError(err) && d.maxCount < limit; {
+		// a single entry did not fit in the reply
+		d.maxCount = min(2*d.maxCount, limit)
+		util.Debugf("readdir(%x) reply too small, retrying with maxcount=%d", d.fh, d.maxCount)
+
+		entries, cookieVerf, eof, err = d.page(ctx)
+	}
+
+	if IsBadCookieError(err) && d.cookie != 0 {
+		// The server no longer recognizes the cookie, typically because the
+		// directory changed.  Start over and skip what was already returned;
+		// entries may be skipped or repeated if the directory did change.
+		util.Infof("readdir(%x) cookie %d rejected, restarting at entry %d", d.fh, d.cookie, d.pos.Offset)
+		d.cookie = 0
+		d.cookieVerf = 0
+		d.buf = nil
+		d.skip = d.pos.Offset
+		d.eof = false
+
+		entries, cookieVerf, eof, err = d.page(ctx)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if len(entries) == 0 && !eof {
+		// nothing to advance the cookie with, asking again would loop
+		return io.ErrNoProgress
+	}
+
+	if len(entries) > 0 {
+		d.cookie = entries[len(entries)-1].Cookie
+	}
+	d.cookieVerf = cookieVerf
+	d.eof = eof
+
+	if d.skip > 0 {
+		skip := uint64(len(entries))
+		if d.skip < skip {
+			skip = d.skip
+		}
+
+		entries = entries[skip:]
+		d.skip -= skip
+	}
+
+	d.buf = append(d.buf, entries...)
+	return nil
+}
+
+// page fetches the entries after d.cookie, falling back to READDIR if the
+// server refuses READDIRPLUS.
+func (d *DirReader) page(ctx context.Context) ([]*EntryPlus, uint64, bool, error) {
+	v := d.v
+	if !d.plus {
+		return v.readDirPage(ctx, d.fh, d.cookie, d.cookieVerf, d.maxCount)
+	}
+
+	if atomic.LoadUint32(&v.noReadDirPlus) == 0 {
+		entries, cookieVerf, eof, err := v.readDirPlusPage(ctx, d.fh, d.cookie, d.cookieVerf, d.dirCount, d.maxCount)
+		if !isNotSupported(err) {
+			return entries, cookieVerf, eof, err
+		}
+
+		util.Infof("readdirplus not supported by server, falling back to readdir: %s", err)
+		atomic.StoreUint32(&v.noReadDirPlus, 1)
+	}
+
+	// the attributes and handles are left for Resolve to fill in
+	return v.readDirPage(ctx, d.fh, d.cookie, d.cookieVerf, d.maxCount)
+}
+
+// Resolve fills in the attributes and handle of entry, as returned by Next or
+// ReadDir, if the server did not return them.  That happens when the server
+// does not support READDIRPLUS and the directory is listed with READDIR, in
+// which case Resolve looks the entry up; READDIR returns no handle to GETATTR
+// the entry with.  If the entry was removed since it was listed, Resolve fails
+// with os.ErrNotExist.
+func (d *DirReader) Resolve(entry *EntryPlus) error {
+	return d.ResolveContext(context.Background(), entry)
+}
+
+// ResolveContext is Resolve with a context
+func (d *DirReader) ResolveContext(ctx context.Context, entry *EntryPlus) error {
+	if entry.Attr.IsSet && entry.Handle.IsSet {
+		return nil
+	}
+
+	fattr, fh, err := d.v.lookup(ctx, d.fh, entry.FileName)
+	if err != nil {
+		return err
+	}
+
+	entry.Attr = PostOpAttr{IsSet: true, Attr: *fattr}
+	entry.Handle = PostOpFH3{IsSet: true, FH: fh}
+	return nil
+}
+
+// ReadDirPlus lists a directory along with the attributes and handles of its
+// entries.  If the server does not support READDIRPLUS, the directory is
+// listed with READDIR and every entry is looked up instead; entries removed in
+// the meantime are left out.
+//
+// All entries are held in memory; use OpenDir for large directories.
+func (v *Target) ReadDirPlus(dir string) ([]*EntryPlus, error) {
+	return v.ReadDirPlusContext(context.Background(), dir)
+}
+
+// ReadDirPlusContext is ReadDirPlus with a context
+func (v *Target) ReadDirPlusContext(ctx context.Context, dir string) ([]*EntryPlus, error) {
+	_, fh, err := v.LookupContext(ctx, dir, FollowIntermediate|FollowLast)
+	if err != nil {
+		return nil, err
+	}
+
+	return v.readDirPlus(ctx, fh)
+}
+
+// ReadDir lists the names and cookies of the entries in a directory.  The
+// attributes and handles of the returned entries are not set.
+func (v *Target) ReadDir(dir string) ([]*EntryPlus, error) {
+	return v.ReadDirContext(context.Background(), dir)
+}
+
+// ReadDirContext is ReadDir with a context
+func (v *Target) ReadDirContext(ctx context.Context, dir string) ([]*EntryPlus, error) {
+	_, fh, err := v.LookupContext(ctx, dir, FollowIntermediate|FollowLast)
+	if err != nil {
+		return nil, err
+	}
+
+	return v.openDir(fh, false, DirCookie{}).ReadDirContext(ctx, -1)
+}
+
+func (v *Target) readDirPlus(ctx context.Context, fh []byte) ([]*EntryPlus, error) {
+	d := v.openDir(fh, true, DirCookie{})
+	entries, err := d.ReadDirContext(ctx, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	resolved := entries[:0]
+	for _, entry := range entries {
+		err := d.ResolveContext(ctx, entry)
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		resolved = append(resolved, entry)
+	}
+
+	return resolved, nil
+}
+
+// isNotSupported returns true if err says the server does not implement a
+// procedure.
+func isNotSupported(err error) bool {
+	if err == rpc.ErrProcUnavail {
+		return true
+	}
+
+	nfsErr, ok := err.(*Error)
+	return ok && nfsErr.ErrorNum == NFS3ErrNotSupp
+}
+
+// readDirPlusPage returns a page of entries after cookie, the cookie verifier
+// to continue with, and whether the end of the directory was reached.
+func (v *Target) readDirPlusPage(ctx context.Context, fh []byte, cookie, cookieVerf uint64, dircount, maxcount uint32) ([]*EntryPlus, uint64, bool, error) {
+	type ReadDirPlus3Args struct {
+		rpc.Header
+		FH         []byte
+		Cookie     uint64
+		CookieVerf uint64
+		DirCount   uint32
+		MaxCount   uint32
+	}
+
+	type DirListPlus3 struct {
+		IsSet bool      `xdr:"union"`
+		Entry EntryPlus `xdr:"unioncase=1"`
+	}
+
+	type DirListOK struct {
+		DirAttrs   PostOpAttr
+		CookieVerf uint64
+	}
+
+	res, err := v.call(ctx, &ReadDirPlus3Args{
+		Header: rpc.Header{
+			Rpcvers: 2,
+			Prog:    Nfs3Prog,
+			Vers:    Nfs3Vers,
+			Proc:    NFSProc3ReadDirPlus,
+			Cred:    v.auth,
+			Verf:    rpc.AuthNull,
+		},
+		FH:         fh,
+		Cookie:     cookie,
+		CookieVerf: cookieVerf,
+		DirCount:   dircount,
+		MaxCount:   maxcount,
+	})
+
+	if err != nil {
+		util.Debugf("readdir(%x): %s", fh, err.Error())
+		return nil, 0, false, err
+	}
+
+	// The dir list entries are so-called "optional-data".  We need to check
+	// the Follows fields before continuing down the array.  Effectively, it's
+	// an encoding used to flatten a linked list into an array where the
+	// Follows field is set when the next idx has data. See
+	// https://tools.ietf.org/html/rfc4506.html#section-4.19 for details.
+	dirlistOK := new(DirListOK)
+	if err = xdr.Read(res, dirlistOK); err != nil {
+		util.Errorf("readdir failed to parse result (%x): %s", fh, err.Error())
+		util.Debugf("partial dirlist: %+v", dirlistOK)
+		return nil, 0, false, err
+	}
+
+	var entries []*EntryPlus
+	for {
+		var item DirListPlus3
+		if err = xdr.Read(res, &item); err != nil {
+			util.Errorf("readdir failed to parse directory entry, aborting")
+			util.Debugf("partial dirent: %+v", item)
+			return nil, 0, false, err
+		}
+
+		if !item.IsSet {
+			break
+		}
+
+		entries = append(entries, &item.Entry)
+	}
+
+	var eof bool
+	if err = xdr.Read(res, &eof); err != nil {
+		util.Errorf("readdir failed to determine presence of more data to read, aborting")
+		return nil, 0, false, err
+	}
+
+	return entries, dirlistOK.CookieVerf, eof, nil
+}
+
+// readDirPage is the READDIR equivalent of readDirPlusPage.  READDIR replies
+// carry no attributes, so only the size of the whole reply is given.
+func (v *Target) readDirPage(ctx context.Context, fh []byte, cookie, cookieVerf uint64, count uint32) ([]*EntryPlus, uint64, bool, error) {
+	type ReadDir3Args struct {
+		rpc.Header
+		FH         []byte
+		Cookie     uint64
+		CookieVerf uint64
+		Count      uint32
+	}
+
+	type Entry3 struct {
+		FileId   uint64
+		FileName string
+		Cookie   uint64
+	}
+
+	type DirList3 struct {
+		IsSet bool   `xdr:"union"`
+		Entry Entry3 `xdr:"unioncase=1"`
+	}
+
+	type DirListOK struct {
+		DirAttrs   PostOpAttr
+		CookieVerf uint64
+	}
+
+	res, err := v.call(ctx, &ReadDir3Args{
+		Header: rpc.Header{
+			Rpcvers: 2,
+			Prog:    Nfs3Prog,
+			Vers:    Nfs3Vers,
+			Proc:    NFSProc3ReadDir,
+			Cred:    v.auth,
+			Verf:    rpc.AuthNull,
+		},
+		FH:         fh,
+		Cookie:     cookie,
+		CookieVerf: cookieVerf,
+		Count:      count,
+	})
+
+	if err != nil {
+		util.Debugf("readdir(%x): %s", fh, err.Error())
+		return nil, 0, false, err
+	}
+
+	// See readDirPlusPage for the encoding of the entries
+	dirlistOK := new(DirListOK)
+	if err = xdr.Read(res, dirlistOK); err != nil {
+		util.Errorf("readdir failed to parse result (%x): %s", fh, err.Error())
+		util.Debugf("partial dirlist: %+v", dirlistOK)
+		return nil, 0, false, err
+	}
+
+	var entries []*EntryPlus
+	for {
+		var item DirList3
+		if err = xdr.Read(res, &item); err != nil {
+			util.Errorf("readdir failed to parse directory entry, aborting")
+			util.Debugf("partial dirent: %+v", item)
+			return nil, 0, false, err
+		}
+
+		if !item.IsSet {
+			break
+		}
+
+		entries = append(entries, &EntryPlus{
+			FileId:   item.Entry.FileId,
+			FileName: item.Entry.FileName,
+			Cookie:   item.Entry.Cookie,
+		})
+	}
+
+	var eof bool
+	if err = xdr.Read(res, &eof); err != nil {
+		util.Errorf("readdir failed to determine presence of more data to read, aborting")
+		return nil, 0, false, err
+	}
+
+	return entries, dirlistOK.CookieVerf, eof, nil
+}
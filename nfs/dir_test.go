@@ -0,0 +1,391 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+package nfs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/zesagata/go-nfs-client/nfs/xdr"
+)
+
+// noReadDirPlus makes the server refuse READDIRPLUS, and returns the number of
+// LOOKUPs it serves from then on
+func noReadDirPlus(s *fakeServer) *int32 {
+	var lookups int32
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lookup := s.handlers[NFSProc3Lookup]
+	s.handlers[NFSProc3Lookup] = func(args io.Reader) []byte {
+		atomic.AddInt32(&lookups, 1)
+		return lookup(args)
+	}
+
+	s.handlers[NFSProc3ReadDirPlus] = func(args io.Reader) []byte {
+		return encode(NFS3ErrNotSupp, PostOpAttr{})
+	}
+
+	return &lookups
+}
+
+func TestReadDirFallback(t *testing.T) {
+	s := newFakeServer(t)
+	s.file("d/a", "a")
+	s.file("d/b", "bb")
+	s.mkdir("d/c")
+
+	v := s.target()
+	lookups := noReadDirPlus(s)
+
+	d, err := v.OpenDir("d")
+	if err != nil {
+		t.Fatalf("opendir: %s", err)
+	}
+	atomic.StoreInt32(lookups, 0)
+
+	entries, err := d.ReadDir(-1)
+	if err != nil || len(entries) != 5 {
+		t.Fatalf("readdir: %d entries, %v", len(entries), err)
+	}
+
+	// nothing is looked up until asked for
+	if n := atomic.LoadInt32(lookups); n != 0 {
+		t.Fatalf("expected no LOOKUPs while listing, got %d", n)
+	}
+
+	for _, entry := range entries {
+		if entry.Attr.IsSet || entry.Handle.IsSet {
+			t.Fatalf("entry %s has attributes from READDIR", entry.FileName)
+		}
+	}
+
+	b := entries[3]
+	if err = d.Resolve(b); err != nil {
+		t.Fatalf("resolve: %s", err)
+	}
+
+	if b.FileName != "b" || b.Size() != 2 || !b.Handle.IsSet {
+		t.Fatalf("resolved entry: %+v", b)
+	}
+
+	// resolving again costs nothing
+	d.Resolve(b)
+	if n := atomic.LoadInt32(lookups); n != 1 {
+		t.Fatalf("expected 1 LOOKUP, got %d", n)
+	}
+
+	// an entry removed since it was listed
+	s.mu.Lock()
+	dir := s.nodes[s.nodes[fakeRootID].children["d"]]
+	delete(dir.children, "c")
+	s.mu.Unlock()
+
+	if err = d.Resolve(entries[4]); !os.IsNotExist(err) {
+		t.Fatalf("resolve of a removed entry: expected not exist, got %v", err)
+	}
+
+	// ReadDirPlus looks up every entry, and leaves out removed ones
+	plus, err := v.ReadDirPlus("d")
+	if err != nil || len(plus) != 4 {
+		t.Fatalf("readdirplus: %d entries, %v", len(plus), err)
+	}
+
+	for _, entry := range plus {
+		if !entry.Attr.IsSet || !entry.Handle.IsSet {
+			t.Fatalf("entry %s has no attributes", entry.FileName)
+		}
+	}
+}
+
+// removedOnLookup makes the server answer LOOKUPs of name with NFS3ERR_NOENT,
+// as if it was removed after being listed
+func removedOnLookup(s *fakeServer, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lookup := s.handlers[NFSProc3Lookup]
+	s.handlers[NFSProc3Lookup] = func(args io.Reader) []byte {
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(args)
+
+		var what Diropargs3
+		xdr.Read(bytes.NewReader(buf.Bytes()), &what)
+		if what.Filename == name {
+			return encode(NFS3ErrNoEnt, PostOpAttr{})
+		}
+
+		return lookup(buf)
+	}
+}
+
+func TestReadDirPlusFallbackRemoved(t *testing.T) {
+	s := newFakeServer(t)
+	s.file("a", "")
+	s.file("gone", "")
+
+	v := s.target()
+	noReadDirPlus(s)
+	removedOnLookup(s, "gone")
+
+	entries, err := v.ReadDirPlus(".")
+	if err != nil {
+		t.Fatalf("readdirplus: %s", err)
+	}
+
+	for _, entry := range entries {
+		if entry.FileName == "gone" {
+			t.Fatalf("entry removed after it was listed was returned")
+		}
+	}
+
+	if len(entries) != 3 {
+		t.Fatalf("expected ., .. and a, got %d entries", len(entries))
+	}
+}
+
+// names returns the names of all the remaining entries of d
+func names(t *testing.T, d *DirReader) []string {
+	entries, err := d.ReadDir(-1)
+	if err != nil {
+		t.Fatalf("readdir: %s", err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.FileName)
+	}
+
+	return names
+}
+
+// pagedDir creates a directory of n files, and returns a Target that lists it
+// a few entries at a time, along with all its entry names
+func pagedDir(t *testing.T, n int) (*fakeServer, *Target, []string) {
+	s := newFakeServer(t)
+	for i := 0; i < n; i++ {
+		s.file("d/"+strconv.Itoa(i), "")
+	}
+
+	v := s.target()
+
+	// the fake server returns maxcount/160 entries per READDIRPLUS
+	v.SetReadDirSize(0, 3*160)
+
+	d, err := v.OpenDir("d")
+	if err != nil {
+		t.Fatalf("opendir: %s", err)
+	}
+
+	return s, v, names(t, d)
+}
+
+func TestResumeDir(t *testing.T) {
+	_, v, all := pagedDir(t, 10)
+	if len(all) != 12 {
+		t.Fatalf("expected 12 entries, got %d", len(all))
+	}
+
+	d, _ := v.OpenDir("d")
+	first, err := d.ReadDir(5)
+	if err != nil || len(first) != 5 {
+		t.Fatalf("readdir: %d entries, %v", len(first), err)
+	}
+
+	pos := d.Checkpoint()
+	if pos.Offset != 5 || pos.Cookie != first[4].Cookie {
+		t.Fatalf("unexpected checkpoint: %+v", pos)
+	}
+
+	d, err = v.ResumeDir("d", pos)
+	if err != nil {
+		t.Fatalf("resumedir: %s", err)
+	}
+
+	if rest := names(t, d); strings.Join(rest, " ") != strings.Join(all[5:], " ") {
+		t.Fatalf("resumed listing: expected %v, got %v", all[5:], rest)
+	}
+
+	// a cookie the server no longer knows restarts the listing, skipping
+	// what was returned before the checkpoint
+	d, _ = v.ResumeDir("d", DirCookie{Cookie: 1000, Offset: 7})
+	if rest := names(t, d); strings.Join(rest, " ") != strings.Join(all[7:], " ") {
+		t.Fatalf("listing resumed from a stale cookie: expected %v, got %v", all[7:], rest)
+	}
+}
+
+func TestReadDirBadCookie(t *testing.T) {
+	s, v, all := pagedDir(t, 10)
+
+	// reject the first cookie after the first page, as after a change to
+	// the directory
+	var rejected int32
+	s.mu.Lock()
+	readdirplus := s.handlers[NFSProc3ReadDirPlus]
+	s.handlers[NFSProc3ReadDirPlus] = func(args io.Reader) []byte {
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(args)
+
+		var readdirArgs struct {
+			FH     []byte
+			Cookie uint64
+		}
+		xdr.Read(bytes.NewReader(buf.Bytes()), &readdirArgs)
+		if readdirArgs.Cookie != 0 && atomic.CompareAndSwapInt32(&rejected, 0, 1) {
+			return encode(NFS3ErrBadCookie, PostOpAttr{})
+		}
+
+		return readdirplus(buf)
+	}
+	s.mu.Unlock()
+
+	d, _ := v.OpenDir("d")
+	got := names(t, d)
+	if atomic.LoadInt32(&rejected) != 1 {
+		t.Fatalf("the cookie was never rejected")
+	}
+
+	if strings.Join(got, " ") != strings.Join(all, " ") {
+		t.Fatalf("listing restarted after BAD_COOKIE: expected %v, got %v", all, got)
+	}
+}
+
+// readDirPlusSizes records the dircount and maxcount of the READDIRPLUS calls
+// to s, and answers NFS3ERR_TOOSMALL to those with a maxcount below tooSmall
+func readDirPlusSizes(s *fakeServer, tooSmall uint32) func() [][2]uint32 {
+	var (
+		mu    sync.Mutex
+		sizes [][2]uint32
+	)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	readdirplus := s.handlers[NFSProc3ReadDirPlus]
+	s.handlers[NFSProc3ReadDirPlus] = func(args io.Reader) []byte {
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(args)
+
+		var readdirArgs struct {
+			FH         []byte
+			Cookie     uint64
+			CookieVerf uint64
+			DirCount   uint32
+			MaxCount   uint32
+		}
+		xdr.Read(bytes.NewReader(buf.Bytes()), &readdirArgs)
+
+		mu.Lock()
+		sizes = append(sizes, [2]uint32{readdirArgs.DirCount, readdirArgs.MaxCount})
+		mu.Unlock()
+
+		if readdirArgs.MaxCount < tooSmall {
+			return encode(NFS3ErrTooSmall, PostOpAttr{})
+		}
+
+		return readdirplus(buf)
+	}
+
+	return func() [][2]uint32 {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return append([][2]uint32(nil), sizes...)
+	}
+}
+
+func TestReadDirContext(t *testing.T) {
+	s := newFakeServer(t)
+	s.file("d/f", "")
+
+	v := s.target()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := v.ReadDirContext(ctx, "."); err != context.Canceled {
+		t.Fatalf("readdir with a canceled context: expected context.Canceled, got %v", err)
+	}
+
+	if _, err := v.ReadDirPlusContext(ctx, "."); err != context.Canceled {
+		t.Fatalf("readdirplus with a canceled context: expected context.Canceled, got %v", err)
+	}
+}
+
+func TestReadDirSize(t *testing.T) {
+	s := newFakeServer(t)
+	s.file("f", "")
+
+	v := s.target()
+	sizes := readDirPlusSizes(s, 0)
+
+	// DTPref and RTMax from FSINFO
+	if _, err := v.ReadDirPlus("."); err != nil {
+		t.Fatalf("readdirplus: %s", err)
+	}
+
+	if got := sizes(); got[0] != [2]uint32{4096, 64 * 1024} {
+		t.Fatalf("expected dircount 4096 and maxcount 65536, got %v", got[0])
+	}
+
+	v.SetReadDirSize(1024, 8192)
+	if _, err := v.ReadDirPlus("."); err != nil {
+		t.Fatalf("readdirplus: %s", err)
+	}
+
+	if got := sizes(); got[len(got)-1] != [2]uint32{1024, 8192} {
+		t.Fatalf("expected dircount 1024 and maxcount 8192, got %v", got[len(got)-1])
+	}
+}
+
+func TestReadDirTooSmall(t *testing.T) {
+	s := newFakeServer(t)
+	s.file("f", "")
+
+	v := s.target()
+	v.SetReadDirSize(0, 1024)
+	sizes := readDirPlusSizes(s, 4096)
+
+	if _, err := v.ReadDirPlus("."); err != nil {
+		t.Fatalf("readdirplus: %s", err)
+	}
+
+	var maxcounts []uint32
+	for _, size := range sizes() {
+		maxcounts = append(maxcounts, size[1])
+	}
+
+	if len(maxcounts) != 3 || maxcounts[0] != 1024 || maxcounts[1] != 2048 || maxcounts[2] != 4096 {
+		t.Fatalf("expected maxcount to double from 1024 to 4096, got %v", maxcounts)
+	}
+
+	// never more than RTMax, 64KiB
+	s = newFakeServer(t)
+	v = s.target()
+	v.SetReadDirSize(0, 40*1024)
+	sizes = readDirPlusSizes(s, 1<<30)
+
+	if _, err := v.ReadDirPlus("."); !IsTooSmallError(err) {
+		t.Fatalf("expected NFS3ERR_TOOSMALL, got %v", err)
+	}
+
+	got := sizes()
+	if last := got[len(got)-1][1]; len(got) != 2 || last != 64*1024 {
+		t.Fatalf("expected maxcount to grow to RTMax once, got %v", got)
+	}
+
+	// over UDP, FSINFO is limited to what fits in a datagram
+	fsinfo := &FSInfo{RTMax: 1 << 20}
+	clampFSInfo(fsinfo, 32*1024)
+	v.fsinfo = fsinfo
+	if limit := v.maxReadDirSize(); limit != 32*1024 {
+		t.Fatalf("expected a 32KiB limit over UDP, got %d", limit)
+	}
+}
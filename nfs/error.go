@@ -122,3 +122,55 @@ func IsNotDirError(err error) bool {
 
 	return false
 }
+
+func IsNotSyncError(err error) bool {
+	nfsErr, ok := err.(*Error)
+	if !ok {
+		return false
+	}
+
+	if nfsErr.ErrorNum == NFS3ErrNotSync {
+		return true
+	}
+
+	return false
+}
+
+func IsXDevError(err error) bool {
+	nfsErr, ok := err.(*Error)
+	if !ok {
+		return false
+	}
+
+	if nfsErr.ErrorNum == NFS3ErrXDev {
+		return true
+	}
+
+	return false
+}
+
+func IsBadCookieError(err error) bool {
+	nfsErr, ok := err.(*Error)
+	if !ok {
+		return false
+	}
+
+	if nfsErr.ErrorNum == NFS3ErrBadCookie {
+		return true
+	}
+
+	return false
+}
+
+func IsTooSmallError(err error) bool {
+	nfsErr, ok := err.(*Error)
+	if !ok {
+		return false
+	}
+
+	if nfsErr.ErrorNum == NFS3ErrTooSmall {
+		return true
+	}
+
+	return false
+}
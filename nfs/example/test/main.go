@@ -158,7 +158,7 @@ func testFileRW(v *nfs.Target, name string, filesize uint64) error {
 		return err
 	}
 
-	wr, err := v.OpenFile(name, 0777)
+	wr, err := v.OpenFile(name, os.O_RDWR|os.O_CREATE, 0777)
 	if err != nil {
 		util.Errorf("write fail: %s", err.Error())
 		return err
@@ -0,0 +1,15 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+package nfs
+
+import "testing"
+
+// NewFakeTarget returns a Target for an empty export of an in-memory server,
+// for the tests of the adapter packages.  Those tests live here, in package
+// nfs_test, rather than next to aferofs and billyfs: the fake server is in the
+// test files of package nfs, which other packages cannot import, and moving
+// it to a package of its own would make the tests of package nfs import a
+// package that imports nfs.
+func NewFakeTarget(t *testing.T) *Target {
+	return newFakeServer(t).target()
+}
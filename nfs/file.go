@@ -3,9 +3,14 @@
 package nfs
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"os"
+	"path"
+	"sync"
+	"time"
 
 	"github.com/zesagata/go-nfs-client/nfs/rpc"
 	"github.com/zesagata/go-nfs-client/nfs/util"
@@ -23,50 +28,252 @@ type File struct {
 
 	// filehandle to the file
 	fh []byte
+
+	// name of the file, as passed to Open or OpenFile
+	name string
+
+	// opened with O_APPEND
+	appending bool
+
+	// set when reading ahead, see SetReadAhead
+	ra *readAhead
+
+	// set when writing behind, see SetWriteBehind
+	wb *writeBehind
+
+	// how writes are sent, see SetStability
+	stable StableHow
+
+	// data written Unstable and not yet committed, see Sync.  commitLock
+	// serializes Sync.
+	pending     []uncommitted
+	pendingSize int
+	pendingLock sync.Mutex
+	commitLock  sync.Mutex
+
+	// size of the file for SeekEnd, see CacheSize.  Negative if not known.
+	// Guarded by sizeLock, as WriteAt may update it concurrently.
+	cacheSize  bool
+	cachedSize int64
+	sizeLock   sync.Mutex
+}
+
+// Stat returns the current attributes of the file
+func (f *File) Stat() (os.FileInfo, error) {
+	return f.StatContext(context.Background())
+}
+
+// StatContext is Stat with a context
+func (f *File) StatContext(ctx context.Context) (os.FileInfo, error) {
+	if err := f.flushWrites(ctx); err != nil {
+		return nil, err
+	}
+
+	fattr, err := f.getattr(ctx, f.fh)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileInfo{Fattr: *fattr, name: path.Base(f.name)}, nil
+}
+
+// SetAttr applies attrs to the file.  See Target.SetAttr for the semantics of
+// guard.
+func (f *File) SetAttr(attrs Sattr3, guard *NFS3Time) (*WccData, error) {
+	return f.SetAttrContext(context.Background(), attrs, guard)
+}
+
+// SetAttrContext is SetAttr with a context
+func (f *File) SetAttrContext(ctx context.Context, attrs Sattr3, guard *NFS3Time) (*WccData, error) {
+	return f.setattr(ctx, f.fh, attrs, guard)
+}
+
+// Chmod changes the permission bits of the file
+func (f *File) Chmod(mode os.FileMode) error {
+	return f.ChmodContext(context.Background(), mode)
+}
+
+// ChmodContext is Chmod with a context
+func (f *File) ChmodContext(ctx context.Context, mode os.FileMode) error {
+	_, err := f.setattr(ctx, f.fh, chmodAttr(mode), nil)
+	return err
+}
+
+// Chown changes the owner and group of the file.  A uid or gid of -1 leaves
+// that value unchanged.
+func (f *File) Chown(uid, gid int) error {
+	return f.ChownContext(context.Background(), uid, gid)
+}
+
+// ChownContext is Chown with a context
+func (f *File) ChownContext(ctx context.Context, uid, gid int) error {
+	_, err := f.setattr(ctx, f.fh, chownAttr(uid, gid), nil)
+	return err
+}
+
+// Chtimes changes the access and modification times of the file
+func (f *File) Chtimes(atime time.Time, mtime time.Time) error {
+	return f.ChtimesContext(context.Background(), atime, mtime)
+}
+
+// ChtimesContext is Chtimes with a context
+func (f *File) ChtimesContext(ctx context.Context, atime time.Time, mtime time.Time) error {
+	_, err := f.setattr(ctx, f.fh, chtimesAttr(atime, mtime), nil)
+	return err
+}
+
+// Truncate changes the size of the file.  It does not change the offset of
+// the next Read or Write.  The data written unstably is committed first, as
+// writing it again after a server reboot would grow the file back.
+func (f *File) Truncate(size int64) error {
+	return f.TruncateContext(context.Background(), size)
+}
+
+// TruncateContext is Truncate with a context
+func (f *File) TruncateContext(ctx context.Context, size int64) error {
+	if err := f.SyncContext(ctx); err != nil {
+		return err
+	}
+
+	if _, err := f.setattr(ctx, f.fh, truncateAttr(size), nil); err != nil {
+		return err
+	}
+	f.invalidateReadAhead()
+
+	f.sizeLock.Lock()
+	if f.cacheSize {
+		f.cachedSize = size
+	}
+	f.sizeLock.Unlock()
+
+	return nil
 }
 
 // Readlink gets the target of a symlink
 func (f *File) Readlink() (string, error) {
-	type ReadlinkArgs struct {
-		rpc.Header
-		FH []byte
+	return f.ReadlinkContext(context.Background())
+}
+
+// ReadlinkContext is Readlink with a context
+func (f *File) ReadlinkContext(ctx context.Context) (string, error) {
+	return f.readlink(ctx, f.fh)
+}
+
+// Read reads up to len(p) bytes at the current offset.  It keeps issuing
+// READs until p is full or the end of the file is reached, so n < len(p)
+// always comes with an error: io.EOF at the end of the file.
+func (f *File) Read(p []byte) (int, error) {
+	return f.ReadContext(context.Background(), p)
+}
+
+// ReadContext is Read with a context
+func (f *File) ReadContext(ctx context.Context, p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
 	}
 
-	type ReadlinkRes struct {
-		Attr PostOpAttr
-		data []byte
+	if err := f.flushWrites(ctx); err != nil {
+		return 0, err
 	}
 
-	r, err := f.call(&ReadlinkArgs{
-		Header: rpc.Header{
-			Rpcvers: 2,
-			Prog:    Nfs3Prog,
-			Vers:    Nfs3Vers,
-			Proc:    NFSProc3Readlink,
-			Cred:    f.auth,
-			Verf:    rpc.AuthNull,
-		},
-		FH: f.fh,
-	})
+	var (
+		n   int
+		err error
+	)
 
-	if err != nil {
-		util.Debugf("readlink(%x): %s", f.fh, err.Error())
-		return "", err
+	if f.ra != nil {
+		n, err = f.ra.read(ctx, f, p)
+	} else {
+		n, err = f.readFull(ctx, p, f.curr)
 	}
+	f.curr += uint64(n)
+
+	return n, err
+}
 
-	readlinkres := &ReadlinkRes{}
-	if err = xdr.Read(r, readlinkres); err != nil {
-		return "", err
+// ReadAt reads len(p) bytes at offset off, with the semantics of
+// io.ReaderAt.  It does not use or change the offset of Read and Write, and
+// can be called from several goroutines at once.
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	return f.ReadAtContext(context.Background(), p, off)
+}
+
+// ReadAtContext is ReadAt with a context
+func (f *File) ReadAtContext(ctx context.Context, p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("offset cannot be negative")
 	}
 
-	if readlinkres.data, err = xdr.ReadOpaque(r); err != nil {
-		return "", err
+	if err := f.flushWrites(ctx); err != nil {
+		return 0, err
 	}
 
-	return string(readlinkres.data), err
+	return f.readFull(ctx, p, uint64(off))
 }
 
-func (f *File) Read(p []byte) (int, error) {
+// readFull reads len(p) bytes at offset, one chunk per READ.  It returns
+// io.EOF if the end of the file is reached before p is full, and
+// io.ErrNoProgress if the server keeps returning no data without reporting
+// the end of the file.
+func (f *File) readFull(ctx context.Context, p []byte, offset uint64) (int, error) {
+	n := 0
+	for n < len(p) {
+		m, eof, err := f.readAt(ctx, p[n:], offset+uint64(n))
+		n += m
+		if err != nil {
+			return n, err
+		}
+
+		if eof {
+			if n < len(p) {
+				return n, io.EOF
+			}
+			break
+		}
+
+		if m == 0 {
+			return n, io.ErrNoProgress
+		}
+	}
+
+	return n, nil
+}
+
+// readSize returns the size of a READ, the preferred size if the server has
+// one, capped at the maximum
+func (f *File) readSize() uint32 {
+	size := f.fsinfo.RTPref
+	if size == 0 || (f.fsinfo.RTMax != 0 && size > f.fsinfo.RTMax) {
+		size = f.fsinfo.RTMax
+	}
+
+	if size == 0 {
+		// a server that reports neither, read in 8K chunks like v2
+		size = 8192
+	}
+
+	return size
+}
+
+// writeSize returns the size of a WRITE, the preferred size if the server has
+// one, capped at the maximum
+func (f *File) writeSize() uint32 {
+	size := f.fsinfo.WTPref
+	if size == 0 || (f.fsinfo.WTMax != 0 && size > f.fsinfo.WTMax) {
+		size = f.fsinfo.WTMax
+	}
+
+	if size == 0 {
+		size = 8192
+	}
+
+	return size
+}
+
+// readAt issues a single READ of up to readSize bytes at offset into p, and
+// returns the number of bytes read and whether the server reported the end
+// of the file.  The server may return fewer bytes than asked for.
+func (f *File) readAt(ctx context.Context, p []byte, offset uint64) (int, bool, error) {
 	type ReadArgs struct {
 		rpc.Header
 		FH     []byte
@@ -83,10 +290,10 @@ func (f *File) Read(p []byte) (int, error) {
 		}
 	}
 
-	readSize := min(f.fsinfo.RTPref, uint32(len(p)))
-	util.Debugf("read(%x) len=%d offset=%d", f.fh, readSize, f.curr)
+	readSize := min(f.readSize(), uint32(len(p)))
+	util.Debugf("read(%x) len=%d offset=%d", f.fh, readSize, offset)
 
-	r, err := f.call(&ReadArgs{
+	r, err := f.call(ctx, &ReadArgs{
 		Header: rpc.Header{
 			Rpcvers: 2,
 			Prog:    Nfs3Prog,
@@ -96,126 +303,202 @@ func (f *File) Read(p []byte) (int, error) {
 			Verf:    rpc.AuthNull,
 		},
 		FH:     f.fh,
-		Offset: uint64(f.curr),
+		Offset: offset,
 		Count:  readSize,
 	})
 
 	if err != nil {
 		util.Debugf("read(%x): %s", f.fh, err.Error())
-		return 0, err
+		return 0, false, err
 	}
 
 	readres := &ReadRes{}
 	if err = xdr.Read(r, readres); err != nil {
-		return 0, err
+		return 0, false, err
+	}
+
+	if readres.Data.Length > readSize || readres.Data.Length != readres.Count {
+		util.Errorf("read(%x) asked for %d bytes, got count=%d length=%d", f.fh, readSize, readres.Count, readres.Data.Length)
+		return 0, false, fmt.Errorf("read: invalid reply, asked for %d bytes, got count=%d length=%d", readSize, readres.Count, readres.Data.Length)
 	}
 
-	f.curr = f.curr + uint64(readres.Data.Length)
-	n, err := r.Read(p[:readres.Data.Length])
+	n, err := io.ReadFull(r, p[:readres.Data.Length])
 	if err != nil {
-		return n, err
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return n, false, err
+	}
+
+	return n, readres.EOF != 0, nil
+}
+
+func (f *File) Write(p []byte) (int, error) {
+	return f.WriteContext(context.Background(), p)
+}
+
+// WriteContext is Write with a context
+func (f *File) WriteContext(ctx context.Context, p []byte) (int, error) {
+	if f.appending {
+		if err := f.flushWrites(ctx); err != nil {
+			return 0, err
+		}
+
+		fattr, err := f.getattr(ctx, f.fh)
+		if err != nil {
+			return 0, err
+		}
+
+		f.curr = fattr.Filesize
 	}
 
-	if readres.EOF != 0 {
-		err = io.EOF
+	var (
+		n   int
+		err error
+	)
+
+	if f.wb != nil {
+		n, err = f.wb.write(ctx, f, p, f.curr)
+	} else {
+		n, err = f.writeAt(ctx, p, f.curr)
 	}
+	f.curr += uint64(n)
 
 	return n, err
 }
 
-func (f *File) Write(p []byte) (int, error) {
-	type WriteArgs struct {
-		rpc.Header
-		FH     []byte
-		Offset uint64
-		Count  uint32
+// WriteAt writes len(p) bytes at offset off, with the semantics of
+// io.WriterAt.  It does not use or change the offset of Read and Write, and
+// can be called from several goroutines at once.  Like os.File, it fails on
+// a file opened with O_APPEND.
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+	return f.WriteAtContext(context.Background(), p, off)
+}
 
-		// UNSTABLE(0), DATA_SYNC(1), FILE_SYNC(2) default
-		How      uint32
-		Contents []byte
+// WriteAtContext is WriteAt with a context
+func (f *File) WriteAtContext(ctx context.Context, p []byte, off int64) (int, error) {
+	if f.appending {
+		return 0, errors.New("WriteAt on a file opened with O_APPEND")
 	}
 
-	type WriteRes struct {
-		Wcc       WccData
-		Count     uint32
-		How       uint32
-		WriteVerf uint64
+	if off < 0 {
+		return 0, errors.New("offset cannot be negative")
 	}
 
+	if err := f.flushWrites(ctx); err != nil {
+		return 0, err
+	}
+
+	return f.writeAt(ctx, p, uint64(off))
+}
+
+// writeAt writes p at offset, in WRITEs of up to writeSize bytes
+func (f *File) writeAt(ctx context.Context, p []byte, offset uint64) (int, error) {
+	defer f.invalidateReadAhead()
+
 	totalToWrite := uint32(len(p))
 	written := uint32(0)
+	size := f.writeSize()
 
 	for written = 0; written < totalToWrite; {
-		writeSize := min(f.fsinfo.WTPref, totalToWrite-written)
-
-		res, err := f.call(&WriteArgs{
-			Header: rpc.Header{
-				Rpcvers: 2,
-				Prog:    Nfs3Prog,
-				Vers:    Nfs3Vers,
-				Proc:    NFSProc3Write,
-				Cred:    f.auth,
-				Verf:    rpc.AuthNull,
-			},
-			FH:       f.fh,
-			Offset:   f.curr,
-			Count:    writeSize,
-			How:      2,
-			Contents: p[written : written+writeSize],
-		})
+		writeSize := min(size, totalToWrite-written)
+		chunk := p[written : written+writeSize]
+		at := offset + uint64(written)
 
+		count, committed, verf, err := f.writeChunk(ctx, chunk, at, f.stable)
 		if err != nil {
-			util.Errorf("write(%x): %s", f.fh, err.Error())
 			return int(written), err
 		}
 
-		writeres := &WriteRes{}
-		if err = xdr.Read(res, writeres); err != nil {
-			util.Errorf("write(%x) failed to parse result: %s", f.fh, err.Error())
-			util.Debugf("write(%x) partial result: %+v", f.fh, writeres)
-			return int(written), err
+		if count != writeSize {
+			util.Debugf("write(%x) did not write full data payload: sent: %d, written: %d", f.fh, writeSize, count)
 		}
 
-		if writeres.Count != writeSize {
-			util.Debugf("write(%x) did not write full data payload: sent: %d, written: %d", writeSize, writeres.Count)
+		if count == 0 {
+			return int(written), io.ErrShortWrite
 		}
 
-		f.curr += uint64(writeres.Count)
-		written += writeres.Count
+		written += count
+		f.grow(int64(offset + uint64(written)))
 
-		util.Debugf("write(%x) len=%d new_offset=%d written=%d total=%d", f.fh, totalToWrite, f.curr, writeres.Count, written)
+		if committed == Unstable {
+			if err = f.track(ctx, at, chunk[:count], verf); err != nil {
+				return int(written), err
+			}
+		}
+
+		util.Debugf("write(%x) len=%d new_offset=%d written=%d total=%d", f.fh, totalToWrite, offset+uint64(written), count, written)
 	}
 
 	return int(written), nil
 }
 
-// Close commits the file
-func (f *File) Close() error {
-	type CommitArg struct {
+// writeChunk issues a single WRITE of p at offset, and returns the number of
+// bytes written, how they were committed and the write verifier
+func (f *File) writeChunk(ctx context.Context, p []byte, offset uint64, how StableHow) (uint32, StableHow, uint64, error) {
+	type WriteArgs struct {
 		rpc.Header
 		FH     []byte
 		Offset uint64
 		Count  uint32
+
+		// UNSTABLE(0), DATA_SYNC(1), FILE_SYNC(2) default
+		How      uint32
+		Contents []byte
+	}
+
+	type WriteRes struct {
+		Wcc       WccData
+		Count     uint32
+		How       uint32
+		WriteVerf uint64
 	}
 
-	_, err := f.call(&CommitArg{
+	res, err := f.call(ctx, &WriteArgs{
 		Header: rpc.Header{
 			Rpcvers: 2,
 			Prog:    Nfs3Prog,
 			Vers:    Nfs3Vers,
-			Proc:    NFSProc3Commit,
+			Proc:    NFSProc3Write,
 			Cred:    f.auth,
 			Verf:    rpc.AuthNull,
 		},
-		FH: f.fh,
+		FH:       f.fh,
+		Offset:   offset,
+		Count:    uint32(len(p)),
+		How:      uint32(how),
+		Contents: p,
 	})
 
 	if err != nil {
-		util.Debugf("commit(%x): %s", f.fh, err.Error())
-		return err
+		util.Errorf("write(%x): %s", f.fh, err.Error())
+		return 0, 0, 0, err
 	}
 
-	return nil
+	writeres := &WriteRes{}
+	if err = xdr.Read(res, writeres); err != nil {
+		util.Errorf("write(%x) failed to parse result: %s", f.fh, err.Error())
+		util.Debugf("write(%x) partial result: %+v", f.fh, writeres)
+		return 0, 0, 0, err
+	}
+
+	if writeres.Count > uint32(len(p)) {
+		return 0, 0, 0, fmt.Errorf("write: invalid reply, sent %d bytes, server wrote %d", len(p), writeres.Count)
+	}
+
+	return writeres.Count, StableHow(writeres.How), writeres.WriteVerf, nil
+}
+
+// Close commits the data written through the file, see Sync, and drops any
+// data read ahead
+func (f *File) Close() error {
+	return f.CloseContext(context.Background())
+}
+
+// CloseContext is Close with a context
+func (f *File) CloseContext(ctx context.Context) error {
+	f.invalidateReadAhead()
+	return f.SyncContext(ctx)
 }
 
 // Seek sets the offset for the next Read or Write to offset, interpreted according to whence.
@@ -226,44 +509,131 @@ func (f *File) Seek(offset int64, whence int) (int64, error) {
 	// However, as we're working with the shared file system, the file
 	// size might even change between NFSPROC3_GETATTR call and
 	// Seek() call, so don't even try to validate it.
-	// The only disadvantage of not knowing the current file size is that
-	// we cannot do io.SeekEnd seeks.
+	var base int64
 	switch whence {
 	case io.SeekStart:
-		if offset < 0 {
-			return int64(f.curr), errors.New("offset cannot be negative")
-		}
-		f.curr = uint64(offset)
-		return int64(f.curr), nil
 	case io.SeekCurrent:
-		f.curr = uint64(int64(f.curr) + offset)
-		return int64(f.curr), nil
+		base = int64(f.curr)
 	case io.SeekEnd:
-		return int64(f.curr), errors.New("SeekEnd is not supported yet")
+		size, err := f.size(context.Background())
+		if err != nil {
+			return int64(f.curr), err
+		}
+		base = size
 	default:
 		// This indicates serious programming error
 		return int64(f.curr), errors.New("Invalid whence")
 	}
+
+	if base+offset < 0 {
+		return int64(f.curr), errors.New("offset cannot be negative")
+	}
+
+	f.curr = uint64(base + offset)
+	return int64(f.curr), nil
+}
+
+// CacheSize turns on caching of the file size used by io.SeekEnd.  By
+// default every io.SeekEnd fetches the size from the server, as other clients
+// may change the file.  When the file is known not to change behind our back,
+// caching saves a round trip per seek for readers that seek relative to the
+// end a lot.  The cached size follows Write and Truncate through this File.
+func (f *File) CacheSize(enable bool) {
+	f.sizeLock.Lock()
+	defer f.sizeLock.Unlock()
+
+	f.cacheSize = enable
+	f.cachedSize = -1
 }
 
-// OpenFile writes to an existing file or creates one
-func (v *Target) OpenFile(path string, perm os.FileMode) (*File, error) {
-	_, fh, err := v.Lookup(path)
+// size returns the size of the file, from the cache if enabled
+func (f *File) size(ctx context.Context) (int64, error) {
+	f.sizeLock.Lock()
+	cacheSize, cachedSize := f.cacheSize, f.cachedSize
+	f.sizeLock.Unlock()
+
+	if err := f.flushWrites(ctx); err != nil {
+		return 0, err
+	}
+
+	if cacheSize && cachedSize >= 0 {
+		return cachedSize, nil
+	}
+
+	fattr, err := f.getattr(ctx, f.fh)
 	if err != nil {
-		if os.IsNotExist(err) {
-			fh, err = v.Create(path, perm)
-			if err != nil {
-				return nil, err
-			}
-		} else {
-			return nil, err
+		return 0, err
+	}
+
+	f.sizeLock.Lock()
+	if f.cacheSize && f.cachedSize < 0 {
+		f.cachedSize = int64(fattr.Filesize)
+	}
+	f.sizeLock.Unlock()
+
+	return int64(fattr.Filesize), nil
+}
+
+// grow extends the cached size, if any, to cover a write ending at end
+func (f *File) grow(end int64) {
+	f.sizeLock.Lock()
+	defer f.sizeLock.Unlock()
+
+	if f.cacheSize && f.cachedSize >= 0 && end > f.cachedSize {
+		f.cachedSize = end
+	}
+}
+
+// OpenFile opens the named file, following symlinks, with the semantics of
+// os.OpenFile for these flags:
+//
+//	O_CREATE  create the file if it does not exist, with mode perm
+//	O_EXCL    with O_CREATE, fail with os.ErrExist if the file exists, using a
+//	          GUARDED CREATE so that the check is atomic on the server
+//	O_TRUNC   truncate an existing file opened for writing
+//	O_APPEND  position every Write at the end of the file
+//
+// See CreateExclusive for a create that is also safe against retransmission.
+func (v *Target) OpenFile(path string, flag int, perm os.FileMode) (*File, error) {
+	return v.OpenFileContext(context.Background(), path, flag, perm)
+}
+
+// OpenFileContext is OpenFile with a context
+func (v *Target) OpenFileContext(ctx context.Context, path string, flag int, perm os.FileMode) (*File, error) {
+	var (
+		fh      []byte
+		err     error
+		created bool
+	)
+
+	if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+		fh, err = v.create(ctx, path, createGuarded, perm)
+		created = true
+	} else {
+		_, fh, err = v.LookupContext(ctx, path, FollowIntermediate|FollowLast)
+		if os.IsNotExist(err) && flag&os.O_CREATE != 0 {
+			fh, err = v.CreateContext(ctx, path, perm)
+			created = true
 		}
 	}
 
+	if err != nil {
+		return nil, err
+	}
+
 	f := &File{
-		Target: v,
-		fsinfo: v.fsinfo,
-		fh:     fh,
+		Target:    v,
+		fsinfo:    v.fsinfo,
+		fh:        fh,
+		name:      path,
+		appending: flag&os.O_APPEND != 0,
+		stable:    FileSync,
+	}
+
+	if !created && flag&os.O_TRUNC != 0 && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		if err = f.TruncateContext(ctx, 0); err != nil {
+			return nil, err
+		}
 	}
 
 	return f, nil
@@ -271,7 +641,12 @@ func (v *Target) OpenFile(path string, perm os.FileMode) (*File, error) {
 
 // Open opens a file for reading
 func (v *Target) Open(path string) (*File, error) {
-	_, fh, err := v.Lookup(path)
+	return v.OpenContext(context.Background(), path)
+}
+
+// OpenContext is Open with a context
+func (v *Target) OpenContext(ctx context.Context, path string) (*File, error) {
+	_, fh, err := v.LookupContext(ctx, path, FollowIntermediate|FollowLast)
 	if err != nil {
 		return nil, err
 	}
@@ -280,6 +655,8 @@ func (v *Target) Open(path string) (*File, error) {
 		Target: v,
 		fsinfo: v.fsinfo,
 		fh:     fh,
+		name:   path,
+		stable: FileSync,
 	}
 
 	return f, nil
@@ -0,0 +1,1035 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+package nfs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zesagata/go-nfs-client/nfs/xdr"
+)
+
+func TestOpenFileFlags(t *testing.T) {
+	s := newFakeServer(t)
+	s.file("exists", "some data")
+
+	v := s.target()
+	if _, err := v.OpenFile("exists", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644); !os.IsExist(err) {
+		t.Fatalf("O_EXCL on an existing file: expected os.ErrExist, got %v", err)
+	}
+
+	if _, err := v.OpenFile("missing", os.O_RDWR, 0644); !os.IsNotExist(err) {
+		t.Fatalf("open without O_CREATE: expected os.ErrNotExist, got %v", err)
+	}
+
+	f, err := v.OpenFile("new", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		t.Fatalf("O_EXCL create: %s", err)
+	}
+
+	fi, err := f.Stat()
+	if err != nil || fi.Mode().Perm() != 0640 {
+		t.Fatalf("unexpected mode of created file: %v, %v", fi, err)
+	}
+
+	if _, err = v.OpenFile("exists", os.O_RDONLY|os.O_TRUNC, 0); err != nil {
+		t.Fatalf("open read-only: %s", err)
+	}
+
+	if fi, _ = v.Stat("exists"); fi.Size() == 0 {
+		t.Fatalf("O_TRUNC truncated a file opened read-only")
+	}
+
+	if _, err = v.OpenFile("exists", os.O_WRONLY|os.O_TRUNC, 0); err != nil {
+		t.Fatalf("open for truncate: %s", err)
+	}
+
+	if fi, _ = v.Stat("exists"); fi.Size() != 0 {
+		t.Fatalf("expected O_TRUNC to truncate, size is %d", fi.Size())
+	}
+
+	if _, err = v.CreateExclusive("lock", 0600); err != nil {
+		t.Fatalf("exclusive create: %s", err)
+	}
+
+	if fi, _ = v.Stat("lock"); fi.Mode().Perm() != 0600 {
+		t.Fatalf("expected SETATTR after exclusive create, mode is %s", fi.Mode())
+	}
+
+	if _, err = v.CreateExclusive("lock", 0600); !os.IsExist(err) {
+		t.Fatalf("second exclusive create: expected os.ErrExist, got %v", err)
+	}
+}
+
+func TestOpenFileAppend(t *testing.T) {
+	s := newFakeServer(t)
+	s.file("log", "one\n")
+
+	v := s.target()
+	f, err := v.OpenFile("log", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("open for appending: %s", err)
+	}
+
+	// another client extends the file in the meantime
+	other := s.target()
+	g, _ := other.OpenFile("log", os.O_WRONLY, 0)
+	g.WriteAt([]byte("two\n"), 4)
+
+	if _, err = f.Write([]byte("three\n")); err != nil {
+		t.Fatalf("append: %s", err)
+	}
+
+	if _, err = f.WriteAt([]byte("x"), 0); err == nil {
+		t.Fatalf("expected WriteAt to fail on a file opened with O_APPEND")
+	}
+
+	if data, _ := readAll(t, v, "log"); data != "one\ntwo\nthree\n" {
+		t.Fatalf("expected writes to append, got %q", data)
+	}
+
+	// O_APPEND creates a missing file like any other open
+	f, err = v.OpenFile("new", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("open for appending with O_CREATE: %s", err)
+	}
+
+	f.Write([]byte("a"))
+	f.Write([]byte("b"))
+	if data, _ := readAll(t, v, "new"); data != "ab" {
+		t.Fatalf("expected %q, got %q", "ab", data)
+	}
+}
+
+// readAll returns the contents of the named file
+func readAll(t *testing.T, v *Target, p string) (string, error) {
+	f, err := v.Open(p)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+
+	data, err := io.ReadAll(f)
+	return string(data), err
+}
+
+func TestCreateExclusive(t *testing.T) {
+	s := newFakeServer(t)
+	s.file("exists", "")
+
+	var (
+		verfs   []uint64
+		setattr []Sattr3
+	)
+
+	// carry out every CREATE twice, as if the first reply was lost and the
+	// call retransmitted
+	s.mu.Lock()
+	create, setattrProc := s.handlers[NFSProc3Create], s.handlers[NFSProc3SetAttr]
+	s.handlers[NFSProc3Create] = func(args io.Reader) []byte {
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(args)
+
+		var createArgs struct {
+			Where Diropargs3
+			Mode  uint32
+			Verf  uint64
+		}
+		xdr.Read(bytes.NewReader(buf.Bytes()), &createArgs)
+		verfs = append(verfs, createArgs.Verf)
+
+		create(bytes.NewReader(buf.Bytes()))
+		return create(buf)
+	}
+	s.handlers[NFSProc3SetAttr] = func(args io.Reader) []byte {
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(args)
+
+		var setattrArgs struct {
+			FH    []byte
+			Attrs Sattr3
+		}
+		xdr.Read(bytes.NewReader(buf.Bytes()), &setattrArgs)
+		setattr = append(setattr, setattrArgs.Attrs)
+
+		return setattrProc(buf)
+	}
+	s.mu.Unlock()
+
+	v := s.target()
+	if _, err := v.CreateExclusive("lock", 0600); err != nil {
+		t.Fatalf("retransmitted exclusive create: %s", err)
+	}
+
+	// the mode and times, where the server kept the verifier, are set after
+	if len(setattr) != 1 || !setattr[0].Mode.SetIt || setattr[0].Mode.Mode != 0600 ||
+		setattr[0].Mtime.SetIt != SetToServerTime || setattr[0].Atime.SetIt != SetToServerTime {
+		t.Fatalf("expected a SETATTR of the mode and times, got %+v", setattr)
+	}
+
+	if _, err := v.CreateExclusive("exists", 0600); !os.IsExist(err) {
+		t.Fatalf("exclusive create of an existing file: expected os.ErrExist, got %v", err)
+	}
+
+	if len(verfs) != 2 || verfs[0] == verfs[1] {
+		t.Fatalf("expected a new verifier for each create, got %x", verfs)
+	}
+}
+
+func TestCreateWithoutHandle(t *testing.T) {
+	s := newFakeServer(t)
+
+	// reply to CREATE without the optional handle and attributes
+	s.mu.Lock()
+	create := s.handlers[NFSProc3Create]
+	s.handlers[NFSProc3Create] = func(args io.Reader) []byte {
+		if res := create(args); !bytes.Equal(res[:4], encode(NFS3Ok)) {
+			return res
+		}
+
+		return encode(NFS3Ok, PostOpFH3{}, PostOpAttr{}, WccData{})
+	}
+	s.mu.Unlock()
+
+	v := s.target()
+	f, err := v.OpenFile("d", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+
+	if _, err = f.Write([]byte("data")); err != nil {
+		t.Fatalf("write to a file created without a handle: %s", err)
+	}
+
+	if fi, err := v.Stat("d"); err != nil || fi.Size() != 4 {
+		t.Fatalf("stat: %v, %v", fi, err)
+	}
+}
+
+func TestSeekEnd(t *testing.T) {
+	s := newFakeServer(t)
+	s.file("f", "0123456789")
+
+	v := s.target()
+	f, err := v.Open("f")
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+
+	if off, err := f.Seek(-4, io.SeekEnd); err != nil || off != 6 {
+		t.Fatalf("seek from end: expected 6, got %d, %v", off, err)
+	}
+
+	buf := make([]byte, 4)
+	if n, err := f.Read(buf); (err != nil && err != io.EOF) || string(buf[:n]) != "6789" {
+		t.Fatalf("read after seek from end: %q, %v", buf[:n], err)
+	}
+
+	if off, err := f.Seek(-11, io.SeekEnd); err == nil {
+		t.Fatalf("seek before the start of the file succeeded, offset %d", off)
+	}
+
+	f.CacheSize(true)
+	if off, err := f.Seek(0, io.SeekEnd); err != nil || off != 10 {
+		t.Fatalf("seek to cached end: expected 10, got %d, %v", off, err)
+	}
+
+	// grow the file behind the back of f
+	s.mu.Lock()
+	s.nodes[2].attr.Filesize = 20
+	s.mu.Unlock()
+	if off, _ := f.Seek(0, io.SeekEnd); off != 10 {
+		t.Fatalf("expected the cached size to be used, got %d", off)
+	}
+
+	if err = f.Truncate(5); err != nil {
+		t.Fatalf("truncate: %s", err)
+	}
+
+	if off, _ := f.Seek(0, io.SeekEnd); off != 5 {
+		t.Fatalf("expected truncate to update the cached size, got %d", off)
+	}
+}
+
+func TestReadWriteAt(t *testing.T) {
+	s := newFakeServer(t)
+	s.file("f", "")
+
+	v := s.target()
+	f, err := v.OpenFile("f", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+
+	// blocks larger than WTPref/RTPref, so each one takes several calls
+	const blocks, blockSize = 8, 40 * 1024
+
+	var wg sync.WaitGroup
+	for i := 0; i < blocks; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			block := bytes.Repeat([]byte{byte('a' + i)}, blockSize)
+			if n, err := f.WriteAt(block, int64(i*blockSize)); err != nil || n != blockSize {
+				t.Errorf("write block %d: %d, %v", i, n, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if off, _ := f.Seek(0, io.SeekCurrent); off != 0 {
+		t.Fatalf("WriteAt moved the offset to %d", off)
+	}
+
+	for i := 0; i < blocks; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			block := make([]byte, blockSize)
+			if n, err := f.ReadAt(block, int64(i*blockSize)); err != nil || n != blockSize {
+				t.Errorf("read block %d: %d, %v", i, n, err)
+				return
+			}
+
+			if !bytes.Equal(block, bytes.Repeat([]byte{byte('a' + i)}, blockSize)) {
+				t.Errorf("block %d has unexpected contents", i)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	buf := make([]byte, 10)
+	if n, err := f.ReadAt(buf, blocks*blockSize-4); n != 4 || err != io.EOF {
+		t.Fatalf("read past the end: expected 4, io.EOF, got %d, %v", n, err)
+	}
+}
+
+func TestShortReads(t *testing.T) {
+	s := newFakeServer(t)
+	data := bytes.Repeat([]byte("0123456789"), 4096)
+	s.file("f", string(data))
+
+	// shorten every READ to at most limit bytes
+	limit := uint32(1000)
+	s.handlers[NFSProc3Read] = func(args io.Reader) []byte {
+		var readArgs struct {
+			FH     []byte
+			Offset uint64
+			Count  uint32
+		}
+		xdr.Read(args, &readArgs)
+
+		readArgs.Count = min(readArgs.Count, limit)
+		return s.read(bytes.NewReader(encode(0, readArgs)[4:]))
+	}
+
+	v := s.target()
+	f, err := v.Open("f")
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+
+	buf := make([]byte, 3*4096)
+	if n, err := f.Read(buf); err != nil || n != len(buf) || !bytes.Equal(buf, data[:n]) {
+		t.Fatalf("short reads: expected a full buffer, got %d, %v", n, err)
+	}
+
+	rest, err := io.ReadAll(f)
+	if err != nil || !bytes.Equal(rest, data[len(buf):]) {
+		t.Fatalf("read the rest: got %d bytes, %v", len(rest), err)
+	}
+
+	if off, _ := f.Seek(0, io.SeekCurrent); off != int64(len(data)) {
+		t.Fatalf("expected the offset at the end of the file, got %d", off)
+	}
+
+	// a server that returns nothing without reporting the end of the file
+	limit = 0
+	f.Seek(0, io.SeekStart)
+	if n, err := f.Read(buf); n != 0 || err != io.ErrNoProgress {
+		t.Fatalf("empty reads: expected io.ErrNoProgress, got %d, %v", n, err)
+	}
+
+	// a server that returns more than was asked for
+	s.handlers[NFSProc3Read] = func(args io.Reader) []byte {
+		return encode(NFS3Ok, PostOpAttr{}, uint32(20), false, data[:20])
+	}
+
+	if n, err := f.Read(buf[:10]); err == nil {
+		t.Fatalf("oversized reply: expected an error, got %d bytes", n)
+	}
+}
+
+func TestUnstableWrites(t *testing.T) {
+	s := newFakeServer(t)
+	s.file("f", "")
+
+	commits := 0
+	s.handlers[NFSProc3Commit] = func(args io.Reader) []byte {
+		commits++
+		return s.commit(args)
+	}
+
+	v := s.target()
+	f, err := v.OpenFile("f", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+
+	f.SetStability(Unstable)
+	data := bytes.Repeat([]byte("0123456789"), 5000)
+	if _, err = f.Write(data); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+
+	// the server loses the data, so Sync has to write it again
+	s.reboot()
+	if err = f.Sync(); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+
+	if commits != 1 {
+		t.Fatalf("expected 1 COMMIT, got %d", commits)
+	}
+
+	got := make([]byte, len(data))
+	if _, err = f.ReadAt(got, 0); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("data lost by the reboot was not written again: %v", err)
+	}
+
+	// nothing is left to commit
+	s.reboot()
+	if err = f.Close(); err != nil || commits != 1 {
+		t.Fatalf("close: %v, %d COMMITs", err, commits)
+	}
+
+	if _, err = f.ReadAt(got, 0); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("committed data was lost: %v", err)
+	}
+
+	// data truncated away is not written again after a reboot
+	s.file("g", "")
+	if f, err = v.OpenFile("g", os.O_RDWR, 0); err != nil {
+		t.Fatalf("open: %s", err)
+	}
+
+	f.SetStability(Unstable)
+	if _, err = f.Write([]byte("hello")); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+
+	if err = f.Truncate(0); err != nil {
+		t.Fatalf("truncate: %s", err)
+	}
+
+	s.reboot()
+	if err = f.Close(); err != nil {
+		t.Fatalf("close: %s", err)
+	}
+
+	if fi, err := v.Stat("g"); err != nil || fi.Size() != 0 {
+		t.Fatalf("truncated file grew back: %v, %v", fi, err)
+	}
+}
+
+func TestReadAhead(t *testing.T) {
+	s := newFakeServer(t)
+	data := make([]byte, 300*1024)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	s.file("f", string(data))
+
+	// slow READs, recording how many are in flight at once
+	var (
+		mu                 sync.Mutex
+		inFlight, maxReads int
+		limit              = uint32(1 << 20)
+	)
+	s.handlers[NFSProc3Read] = func(args io.Reader) []byte {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxReads {
+			maxReads = inFlight
+		}
+		count := limit
+		mu.Unlock()
+
+		var readArgs struct {
+			FH     []byte
+			Offset uint64
+			Count  uint32
+		}
+		xdr.Read(args, &readArgs)
+
+		time.Sleep(time.Millisecond)
+		readArgs.Count = min(readArgs.Count, count)
+		res := s.read(bytes.NewReader(encode(0, readArgs)[4:]))
+
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+
+		return res
+	}
+
+	v := s.target()
+	f, err := v.Open("f")
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+
+	f.SetReadAhead(8)
+	got, err := io.ReadAll(io.LimitReader(f, int64(len(data))+1))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("sequential read: got %d bytes, %v", len(got), err)
+	}
+
+	mu.Lock()
+	if maxReads < 2 {
+		t.Fatalf("expected READs to be pipelined, at most %d were in flight", maxReads)
+	}
+	mu.Unlock()
+
+	// out of order reads start over at the new offset
+	buf := make([]byte, 5000)
+	for _, off := range []int64{1000, 200 * 1024, 7} {
+		f.Seek(off, io.SeekStart)
+		if n, err := f.Read(buf); err != nil || !bytes.Equal(buf[:n], data[off:off+int64(n)]) {
+			t.Fatalf("read at %d: %d, %v", off, n, err)
+		}
+	}
+
+	// short READs leave holes that have to be read again
+	mu.Lock()
+	limit = 3000
+	mu.Unlock()
+	f.Seek(0, io.SeekStart)
+	got, err = io.ReadAll(f)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("sequential read with short READs: got %d bytes, %v", len(got), err)
+	}
+}
+
+func TestWriteBehind(t *testing.T) {
+	s := newFakeServer(t)
+	s.file("f", "")
+
+	var (
+		mu                  sync.Mutex
+		writes, maxInFlight int
+		inFlight            int
+		fail                bool
+	)
+	s.handlers[NFSProc3Write] = func(args io.Reader) []byte {
+		mu.Lock()
+		writes++
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		failing := fail
+		mu.Unlock()
+
+		time.Sleep(time.Millisecond)
+		res := encode(NFS3ErrNoSpc, WccData{})
+		if !failing {
+			res = s.write(args)
+		}
+
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+
+		return res
+	}
+
+	v := s.target()
+	f, err := v.OpenFile("f", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+
+	// room for 4 WRITEs of WTPref bytes
+	f.SetWriteBehind(4 * 16 * 1024)
+
+	var want []byte
+	for i := 0; i < 1000; i++ {
+		line := []byte(strconv.Itoa(i) + " small writes are coalesced\n")
+		want = append(want, line...)
+		if n, err := f.Write(line); err != nil || n != len(line) {
+			t.Fatalf("write %d: %d, %v", i, n, err)
+		}
+	}
+
+	if err = f.Sync(); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+
+	mu.Lock()
+	if expected := (len(want) + 16*1024 - 1) / (16 * 1024); writes != expected {
+		t.Fatalf("expected %d coalesced WRITEs, got %d", expected, writes)
+	}
+
+	if maxInFlight < 2 || maxInFlight > 4 {
+		t.Fatalf("expected 2 to 4 WRITEs in flight, got %d", maxInFlight)
+	}
+	fail = true
+	mu.Unlock()
+
+	got := make([]byte, len(want))
+	if _, err = f.ReadAt(got, 0); err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("read back: %v", err)
+	}
+
+	// the error of a WRITE shows up on a later call
+	if _, err = f.Write(make([]byte, 100*1024)); err != nil {
+		t.Fatalf("expected the write to be buffered, got %s", err)
+	}
+
+	if err = f.Close(); err == nil || err.Error() != "NFS3ERR_NOSPC" {
+		t.Fatalf("expected the WRITE error from Close, got %v", err)
+	}
+
+	if _, err = f.Write([]byte("x")); err == nil {
+		t.Fatalf("expected the WRITE error to stick")
+	}
+}
+
+// with more than maxUncommitted written UNSTABLE behind, the WRITEs sent
+// behind commit on their own, without waiting for each other
+func TestWriteBehindOverwrite(t *testing.T) {
+	s := newFakeServer(t)
+	s.file("f", "")
+
+	// the first WRITE is held until another one comes, so that they would
+	// be carried out out of order if both were in flight
+	var calls int32
+	second := make(chan struct{})
+	h := s.handlers[NFSProc3Write]
+	s.handlers[NFSProc3Write] = func(args io.Reader) []byte {
+		switch atomic.AddInt32(&calls, 1) {
+		case 1:
+			select {
+			case <-second:
+			case <-time.After(100 * time.Millisecond):
+			}
+		case 2:
+			close(second)
+		}
+
+		return h(args)
+	}
+
+	v := s.target()
+	f, err := v.OpenFile("f", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+
+	f.SetWriteBehind(4 * 16 * 1024)
+	if _, err = f.Write([]byte("AAAA")); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("seek: %s", err)
+	}
+
+	if _, err = f.Write([]byte("BBBB")); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatalf("close: %s", err)
+	}
+
+	if data, err := readAll(t, v, "f"); err != nil || data != "BBBB" {
+		t.Fatalf("expected the second write to win, got %q, %v", data, err)
+	}
+}
+
+func TestWriteBehindUnstable(t *testing.T) {
+	s := newFakeServer(t)
+	s.file("f", "")
+
+	var commits int32
+	s.mu.Lock()
+	commit := s.handlers[NFSProc3Commit]
+	s.handlers[NFSProc3Commit] = func(args io.Reader) []byte {
+		atomic.AddInt32(&commits, 1)
+		return commit(args)
+	}
+	s.mu.Unlock()
+
+	v := s.target()
+	f, err := v.OpenFile("f", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+
+	f.SetStability(Unstable)
+	f.SetWriteBehind(1 << 20)
+
+	done := make(chan error, 1)
+	go func() {
+		chunk := bytes.Repeat([]byte("x"), 1<<20)
+		for i := 0; i < 70; i++ {
+			if _, err := f.Write(chunk); err != nil {
+				done <- err
+				return
+			}
+		}
+
+		done <- f.Close()
+	}()
+
+	select {
+	case err = <-done:
+	case <-time.After(time.Minute):
+		t.Fatalf("deadlock writing %d bytes behind", 70<<20)
+	}
+
+	if err != nil {
+		t.Fatalf("write: %s", err)
+	}
+
+	if n := atomic.LoadInt32(&commits); n < 2 {
+		t.Fatalf("expected a COMMIT past maxUncommitted and one on Close, got %d", n)
+	}
+
+	if fi, _ := v.Stat("f"); fi.Size() != 70<<20 {
+		t.Fatalf("expected %d bytes, got %d", 70<<20, fi.Size())
+	}
+}
+
+// blockProc makes the server hold calls to proc until release is called
+func blockProc(t *testing.T, s *fakeServer, proc uint32) (release func()) {
+	var once sync.Once
+	unblock := make(chan struct{})
+	release = func() { once.Do(func() { close(unblock) }) }
+	t.Cleanup(release)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h := s.handlers[proc]
+	s.handlers[proc] = func(args io.Reader) []byte {
+		<-unblock
+		return h(args)
+	}
+
+	return release
+}
+
+func TestWriteBehindContext(t *testing.T) {
+	s := newFakeServer(t)
+	s.file("f", "")
+
+	v := s.target()
+	f, err := v.OpenFile("f", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+
+	// room for a single WRITE of WTPref bytes
+	f.SetWriteBehind(16 * 1024)
+	release := blockProc(t, s, NFSProc3Write)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	chunk := make([]byte, 16*1024)
+	if _, err = f.WriteContext(ctx, chunk); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+
+	// waiting for the budget gives up with the context, and the data stays
+	// buffered
+	short, stop := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer stop()
+	if n, err := f.WriteContext(short, chunk); err != context.DeadlineExceeded || n != len(chunk) {
+		t.Fatalf("write with the budget used: expected %d bytes buffered and a deadline error, got %d, %v", len(chunk), n, err)
+	}
+
+	// so does waiting for the WRITEs in flight
+	short, stop = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer stop()
+	if err = f.CloseContext(short); err != context.DeadlineExceeded {
+		t.Fatalf("close with a WRITE in flight: expected a deadline error, got %v", err)
+	}
+
+	// the WRITE in flight was sent with the context of the first Write
+	cancel()
+	release()
+	if err = f.Close(); err != context.Canceled {
+		t.Fatalf("close after canceling a WRITE: expected context.Canceled, got %v", err)
+	}
+}
+
+func TestReadAheadContext(t *testing.T) {
+	s := newFakeServer(t)
+	data := make([]byte, 100*1024)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	s.file("f", string(data))
+
+	v := s.target()
+	f, err := v.Open("f")
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+
+	f.SetReadAhead(4)
+	release := blockProc(t, s, NFSProc3Read)
+
+	// the READs sent ahead are canceled along with the Read that sent them
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err = f.ReadContext(ctx, make([]byte, 1024)); err != context.DeadlineExceeded {
+		t.Fatalf("read: expected a deadline error, got %v", err)
+	}
+
+	// and sent again by the next one
+	release()
+	got, err := io.ReadAll(f)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read after a canceled read: %d bytes, %v", len(got), err)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	s := newFakeServer(t)
+	s.file("f", "")
+
+	writes := 0
+	s.handlers[NFSProc3Write] = func(args io.Reader) []byte {
+		s.mu.Lock()
+		writes++
+		s.mu.Unlock()
+		return s.write(args)
+	}
+
+	v := s.target()
+	f, err := v.OpenFile("f", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+
+	data := make([]byte, 200*1024+5)
+	for i := range data {
+		data[i] = byte(i % 253)
+	}
+
+	// hide the WriteTo of bytes.Reader, so io.Copy uses ReadFrom
+	n, err := io.Copy(f, struct{ io.Reader }{bytes.NewReader(data)})
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("copy to file: %d, %v", n, err)
+	}
+
+	s.mu.Lock()
+	if writes != 13 {
+		t.Fatalf("expected 13 WRITEs of WTPref bytes, got %d", writes)
+	}
+	s.mu.Unlock()
+
+	if f.wb != nil {
+		t.Fatalf("copy left write-behind on")
+	}
+
+	f.Seek(0, io.SeekStart)
+	buf := new(bytes.Buffer)
+	if n, err = io.Copy(buf, f); err != nil || !bytes.Equal(buf.Bytes(), data) {
+		t.Fatalf("copy from file: %d, %v", n, err)
+	}
+
+	if off, _ := f.Seek(0, io.SeekCurrent); off != int64(len(data)) {
+		t.Fatalf("expected the offset at the end of the file, got %d", off)
+	}
+}
+
+func TestCopyErrors(t *testing.T) {
+	s := newFakeServer(t)
+	s.file("f", "")
+
+	// a server that prefers no particular size, and runs out of space after
+	// 64KiB
+	s.mu.Lock()
+	var writes []uint32
+	s.handlers[NFSProc3FSInfo] = func(args io.Reader) []byte {
+		return encode(NFS3Ok, FSInfo{Attr: s.nodes[fakeRootID].postOpAttr()})
+	}
+	s.handlers[NFSProc3Write] = func(args io.Reader) []byte {
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(args)
+
+		var writeArgs struct {
+			FH     []byte
+			Offset uint64
+			Count  uint32
+		}
+		xdr.Read(bytes.NewReader(buf.Bytes()), &writeArgs)
+
+		s.mu.Lock()
+		writes = append(writes, writeArgs.Count)
+		s.mu.Unlock()
+
+		if writeArgs.Offset >= 64*1024 {
+			return encode(NFS3ErrNoSpc, WccData{})
+		}
+
+		return s.write(buf)
+	}
+	s.mu.Unlock()
+
+	v := s.target()
+	f, err := v.OpenFile("f", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+
+	data := struct{ io.Reader }{bytes.NewReader(make([]byte, 32*1024))}
+	if _, err = io.Copy(f, data); err != nil {
+		t.Fatalf("copy: %s", err)
+	}
+
+	s.mu.Lock()
+	if len(writes) != 4 || writes[0] != 8192 {
+		t.Fatalf("expected 4 WRITEs of 8KiB without WTPref, got %v", writes)
+	}
+	s.mu.Unlock()
+
+	// the error of a WRITE sent during the copy is returned by it
+	data = struct{ io.Reader }{bytes.NewReader(make([]byte, 1<<20))}
+	if _, err = io.Copy(f, data); err == nil || err.Error() != "NFS3ERR_NOSPC" {
+		t.Fatalf("expected NFS3ERR_NOSPC from the copy, got %v", err)
+	}
+
+	// and not by the next call
+	if _, err = f.WriteAt([]byte("x"), 0); err != nil {
+		t.Fatalf("write after a failed copy: %s", err)
+	}
+}
+
+func TestConnections(t *testing.T) {
+	s := newFakeServer(t)
+	s.file("f", "")
+
+	v := s.target()
+	if err := v.SetConnections(0); err == nil {
+		t.Fatalf("expected an error for no connections")
+	}
+
+	if err := v.SetConnections(4); err != nil {
+		t.Fatalf("set connections: %s", err)
+	}
+
+	f, err := v.OpenFile("f", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+
+	const blocks, blockSize = 16, 8192
+
+	var wg sync.WaitGroup
+	for i := 0; i < blocks; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			block := bytes.Repeat([]byte{byte('a' + i)}, blockSize)
+			if n, err := f.WriteAt(block, int64(i*blockSize)); err != nil || n != blockSize {
+				t.Errorf("write block %d: %d, %v", i, n, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	s.mu.Lock()
+	accepted, writers := len(s.calls), 0
+	for _, calls := range s.calls {
+		if calls[NFSProc3Write] > 0 {
+			writers++
+		}
+	}
+	s.mu.Unlock()
+
+	if accepted != 4 {
+		t.Fatalf("expected 4 connections, got %d", accepted)
+	}
+
+	if writers < 2 {
+		t.Fatalf("expected the WRITEs to be spread over the connections, got %d", writers)
+	}
+
+	// dropping connections waits for the calls in flight on them
+	release := blockProc(t, s, NFSProc3Read)
+	var reads sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		reads.Add(1)
+		go func() {
+			defer reads.Done()
+
+			if _, err := f.ReadAt(make([]byte, blockSize), 0); err != nil {
+				t.Errorf("read across SetConnections: %s", err)
+			}
+		}()
+	}
+
+	// wait until the 4 READs are in flight, spread over the connections
+	for {
+		s.mu.Lock()
+		inflight, dropped := 0, 0
+		for i, calls := range s.calls {
+			inflight += calls[NFSProc3Read]
+			if i > 0 {
+				dropped += calls[NFSProc3Read]
+			}
+		}
+		s.mu.Unlock()
+
+		if inflight == 4 {
+			if dropped == 0 {
+				t.Fatalf("expected READs in flight on the connections to drop")
+			}
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	shrunk := make(chan error)
+	go func() { shrunk <- v.SetConnections(1) }()
+
+	select {
+	case err := <-shrunk:
+		t.Fatalf("set connections returned with calls in flight: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	release()
+	reads.Wait()
+
+	if err := <-shrunk; err != nil {
+		t.Fatalf("set connections: %s", err)
+	}
+
+	// the calls go on the first connection again
+
+	for i := 0; i < blocks; i++ {
+		block := make([]byte, blockSize)
+		if n, err := f.ReadAt(block, int64(i*blockSize)); err != nil || n != blockSize {
+			t.Fatalf("read block %d: %d, %v", i, n, err)
+		}
+
+		if !bytes.Equal(block, bytes.Repeat([]byte{byte('a' + i)}, blockSize)) {
+			t.Fatalf("block %d has unexpected contents", i)
+		}
+	}
+}
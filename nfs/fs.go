@@ -0,0 +1,277 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+package nfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+)
+
+// FS is a read-only io/fs view of a Target.  Names are slash-separated paths
+// relative to the root of the export, as accepted by fs.ValidPath, and
+// symlinks are followed except by Lstat and ReadLink.
+//
+// FS implements fs.FS, fs.ReadDirFS, fs.StatFS and fs.ReadLinkFS.
+type FS struct {
+	v *Target
+}
+
+// FS returns an io/fs view of the export
+func (v *Target) FS() *FS {
+	return &FS{v: v}
+}
+
+// Open opens the named file or directory for reading
+func (fsys *FS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	fattr, fh, err := fsys.lookup(name, FollowLast)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	info := &FileInfo{Fattr: *fattr, name: path.Base(name)}
+	if fattr.IsDir() {
+		return &fsDir{
+			name: name,
+			info: info,
+			d:    fsys.v.openDir(fh, true, DirCookie{}),
+		}, nil
+	}
+
+	return &fsFile{
+		f: &File{
+			Target: fsys.v,
+			fsinfo: fsys.v.fsinfo,
+			fh:     fh,
+			name:   name,
+			stable: FileSync,
+		},
+	}, nil
+}
+
+// ReadDir returns the entries of the named directory sorted by name, without
+// "." and "..".
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+
+	_, fh, err := fsys.lookup(name, FollowLast)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+
+	entries, err := fsys.v.readDirPlus(context.Background(), fh)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+
+	dirents := toDirEntries(entries)
+	sort.Slice(dirents, func(i, j int) bool {
+		return dirents[i].Name() < dirents[j].Name()
+	})
+
+	return dirents, nil
+}
+
+// Stat returns the attributes of the named file, following symlinks
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	return fsys.stat("stat", name, FollowLast)
+}
+
+// Lstat is like Stat, but describes a symlink rather than its target
+func (fsys *FS) Lstat(name string) (fs.FileInfo, error) {
+	return fsys.stat("lstat", name, 0)
+}
+
+// ReadLink returns the target of the named symlink
+func (fsys *FS) ReadLink(name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+
+	fattr, fh, err := fsys.lookup(name, 0)
+	if err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+
+	if fattr.Type != NF3Lnk {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+
+	target, err := fsys.v.readlink(context.Background(), fh)
+	if err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+
+	return target, nil
+}
+
+func (fsys *FS) stat(op, name string, flags LookupOpt) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	fattr, _, err := fsys.lookup(name, flags)
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+
+	return &FileInfo{Fattr: *fattr, name: path.Base(name)}, nil
+}
+
+// lookup resolves name, always following symlinks in its directories, and
+// returns fresh attributes.
+func (fsys *FS) lookup(name string, flags LookupOpt) (*Fattr, []byte, error) {
+	_, fh, err := fsys.v.Lookup(name, FollowIntermediate|flags)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fattr, err := fsys.v.getattr(context.Background(), fh)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return fattr, fh, nil
+}
+
+// toDirEntries converts directory entries, dropping "." and ".."
+func toDirEntries(entries []*EntryPlus) []fs.DirEntry {
+	dirents := make([]fs.DirEntry, 0, len(entries))
+	for _, entry := range entries {
+		if entry.FileName == "." || entry.FileName == ".." {
+			continue
+		}
+
+		dirents = append(dirents, fs.FileInfoToDirEntry(entry))
+	}
+
+	return dirents
+}
+
+// fsFile is a regular file opened through FS
+type fsFile struct {
+	f      *File
+	closed bool
+}
+
+func (f *fsFile) Stat() (fs.FileInfo, error) {
+	if f.closed {
+		return nil, &fs.PathError{Op: "stat", Path: f.f.name, Err: fs.ErrClosed}
+	}
+
+	return f.f.Stat()
+}
+
+func (f *fsFile) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "read", Path: f.f.name, Err: fs.ErrClosed}
+	}
+
+	return f.f.Read(p)
+}
+
+func (f *fsFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "read", Path: f.f.name, Err: fs.ErrClosed}
+	}
+
+	return f.f.ReadAt(p, off)
+}
+
+func (f *fsFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "seek", Path: f.f.name, Err: fs.ErrClosed}
+	}
+
+	return f.f.Seek(offset, whence)
+}
+
+// Close does not commit the file, as nothing was written to it
+func (f *fsFile) Close() error {
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.f.name, Err: fs.ErrClosed}
+	}
+
+	f.closed = true
+	return nil
+}
+
+// fsDir is a directory opened through FS
+type fsDir struct {
+	name   string
+	info   fs.FileInfo
+	d      *DirReader
+	closed bool
+}
+
+func (d *fsDir) Stat() (fs.FileInfo, error) {
+	if d.closed {
+		return nil, &fs.PathError{Op: "stat", Path: d.name, Err: fs.ErrClosed}
+	}
+
+	return d.info, nil
+}
+
+func (d *fsDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+// ReadDir has the semantics of fs.ReadDirFile, and skips "." and "..".  The
+// attributes of entries listed without them are looked up, and entries
+// removed in the meantime are left out.
+func (d *fsDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d.closed {
+		return nil, &fs.PathError{Op: "readdir", Path: d.name, Err: fs.ErrClosed}
+	}
+
+	var dirents []fs.DirEntry
+	for n <= 0 || len(dirents) < n {
+		entry, err := d.d.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return dirents, &fs.PathError{Op: "readdir", Path: d.name, Err: err}
+		}
+
+		if entry.FileName == "." || entry.FileName == ".." {
+			continue
+		}
+
+		err = d.d.Resolve(entry)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+
+		if err != nil {
+			return dirents, &fs.PathError{Op: "readdir", Path: d.name, Err: err}
+		}
+
+		dirents = append(dirents, fs.FileInfoToDirEntry(entry))
+	}
+
+	if n > 0 && len(dirents) == 0 {
+		return nil, io.EOF
+	}
+
+	return dirents, nil
+}
+
+func (d *fsDir) Close() error {
+	if d.closed {
+		return &fs.PathError{Op: "close", Path: d.name, Err: fs.ErrClosed}
+	}
+
+	d.closed = true
+	return nil
+}
@@ -0,0 +1,54 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+package nfs
+
+import (
+	"io/fs"
+	"testing"
+	"testing/fstest"
+)
+
+func TestFS(t *testing.T) {
+	t.Run("READDIRPLUS", func(t *testing.T) { testFS(t, false) })
+	t.Run("READDIR", func(t *testing.T) { testFS(t, true) })
+}
+
+// testFS runs fstest.TestFS against a server, which with noPlus does not
+// support READDIRPLUS
+func testFS(t *testing.T, noPlus bool) {
+	s := newFakeServer(t)
+	if noPlus {
+		noReadDirPlus(s)
+	}
+
+	s.file("hello.txt", "hello, world\n")
+	s.file("a/b/c.txt", "c")
+	s.file("a/empty", "")
+	s.mkdir("a/d")
+	s.symlink("a/link", "b/c.txt")
+	s.symlink("abs", "/export/a/b")
+
+	fsys := s.target().FS()
+	if err := fstest.TestFS(fsys, "hello.txt", "a/b/c.txt", "a/empty", "a/d", "a/link", "abs"); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := fs.ReadFile(fsys, "a/link")
+	if err != nil || string(data) != "c" {
+		t.Fatalf("read through symlink: %q, %v", data, err)
+	}
+
+	fi, err := fs.Stat(fsys, "abs/c.txt")
+	if err != nil || fi.Size() != 1 {
+		t.Fatalf("stat through absolute symlink: %v, %v", fi, err)
+	}
+
+	target, err := fsys.ReadLink("abs")
+	if err != nil || target != "/export/a/b" {
+		t.Fatalf("readlink: %q, %v", target, err)
+	}
+
+	if _, err = fsys.Open("../x"); err == nil {
+		t.Fatalf("expected an error for an invalid path")
+	}
+}
@@ -3,6 +3,7 @@
 package nfs
 
 import (
+	"context"
 	"errors"
 	"fmt"
 
@@ -39,12 +40,17 @@ type Mount struct {
 }
 
 func (m *Mount) Unmount() error {
+	return m.UnmountContext(context.Background())
+}
+
+// UnmountContext is Unmount with a context
+func (m *Mount) UnmountContext(ctx context.Context) error {
 	type umount struct {
 		rpc.Header
 		Dirpath string
 	}
 
-	_, err := m.Call(&umount{
+	_, err := m.CallContext(ctx, &umount{
 		rpc.Header{
 			Rpcvers: 2,
 			Prog:    MountProg,
@@ -66,12 +72,18 @@ func (m *Mount) Unmount() error {
 }
 
 func (m *Mount) Mount(dirpath string, auth rpc.Auth) (*Target, error) {
+	return m.MountContext(context.Background(), dirpath, auth)
+}
+
+// MountContext is Mount with a context, which also bounds the FSINFO of the
+// Target it returns
+func (m *Mount) MountContext(ctx context.Context, dirpath string, auth rpc.Auth) (*Target, error) {
 	type mount struct {
 		rpc.Header
 		Dirpath string
 	}
 
-	res, err := m.Call(&mount{
+	res, err := m.CallContext(ctx, &mount{
 		rpc.Header{
 			Rpcvers: 2,
 			Prog:    MountProg,
@@ -103,7 +115,7 @@ func (m *Mount) Mount(dirpath string, auth rpc.Auth) (*Target, error) {
 		m.dirPath = dirpath
 		m.auth = auth
 
-		vol, err := NewTarget(m.Addr, auth, fh, dirpath)
+		vol, err := NewTargetProtoContext(ctx, m.Addr, rpc.IPProtoTCP, auth, fh, dirpath)
 		if err != nil {
 			return nil, err
 		}
@@ -126,12 +138,31 @@ func (m *Mount) Mount(dirpath string, auth rpc.Auth) (*Target, error) {
 	return nil, fmt.Errorf("unknown mount stat: %d", mountstat3)
 }
 
+// mountIdempotent reports whether a MOUNT call can be sent again when the
+// connection is lost.  Mounting or unmounting twice only updates the list of
+// clients the server keeps.
+func mountIdempotent(h rpc.Header) bool {
+	switch h.Proc {
+	case MountProc3Null, MountProc3MNT, MountProc3UMNT, MountProc3Export:
+		return true
+	}
+
+	return false
+}
+
 func DialMount(addr string) (*Mount, error) {
+	return DialMountProto(addr, rpc.IPProtoTCP)
+}
+
+// DialMountProto is like DialMount, but talks to the portmapper and the MOUNT
+// service over prot, rpc.IPProtoTCP or rpc.IPProtoUDP.  Mount still reaches
+// the NFS service over TCP; use NewTargetProto for NFS over UDP.
+func DialMountProto(addr string, prot uint32) (*Mount, error) {
 	// get MOUNT port
 	m := rpc.Mapping{
 		Prog: MountProg,
 		Vers: MountVers,
-		Prot: rpc.IPProtoTCP,
+		Prot: prot,
 		Port: 0,
 	}
 
@@ -140,6 +171,8 @@ func DialMount(addr string) (*Mount, error) {
 		return nil, err
 	}
 
+	client.Reconnect(func() (*rpc.Client, error) { return DialService(addr, m) }, mountIdempotent)
+
 	return &Mount{
 		Client: client,
 		Addr:   addr,
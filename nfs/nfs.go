@@ -1,5 +1,14 @@
 // Copyright © 2017 VMware, Inc. All Rights Reserved.
 // SPDX-License-Identifier: BSD-2-Clause
+
+// Package nfs is an NFSv3 client.  Mount an export with DialMount and
+// Mount, or reach it directly with NewTarget.
+//
+// Most methods that talk to the server have a variant with a Context suffix,
+// such as LookupContext for Lookup, that takes a context.Context.  The
+// context bounds every call the method makes: once it is done, the method
+// stops waiting for the server and returns the error of the context.  The
+// variants without a context use context.Background().
 package nfs
 
 import (
@@ -19,22 +28,40 @@ const (
 	Nfs3Vers = 3
 
 	// program methods
+	NFSProc3GetAttr     = 1
+	NFSProc3SetAttr     = 2
 	NFSProc3Lookup      = 3
+	NFSProc3Access      = 4
 	NFSProc3Readlink    = 5
 	NFSProc3Read        = 6
 	NFSProc3Write       = 7
 	NFSProc3Create      = 8
 	NFSProc3Mkdir       = 9
+	NFSProc3Symlink     = 10
+	NFSProc3Mknod       = 11
 	NFSProc3Remove      = 12
 	NFSProc3RmDir       = 13
+	NFSProc3Rename      = 14
+	NFSProc3Link        = 15
+	NFSProc3ReadDir     = 16
 	NFSProc3ReadDirPlus = 17
+	NFSProc3FSStat      = 18
 	NFSProc3FSInfo      = 19
+	NFSProc3PathConf    = 20
 	NFSProc3Commit      = 21
 
 	// The size in bytes of the opaque cookie verifier passed by
 	// READDIR and READDIRPLUS.
 	NFS3_COOKIEVERFSIZE = 8
 
+	// ACCESS permission bits
+	Access3Read    = 0x0001
+	Access3Lookup  = 0x0002
+	Access3Modify  = 0x0004
+	Access3Extend  = 0x0008
+	Access3Delete  = 0x0010
+	Access3Execute = 0x0020
+
 	// file types
 	NF3Reg  = 1
 	NF3Dir  = 2
@@ -92,6 +119,13 @@ type NFS3Time struct {
 	Nseconds uint32
 }
 
+func toNFS3Time(t time.Time) NFS3Time {
+	return NFS3Time{
+		Seconds:  uint32(t.Unix()),
+		Nseconds: uint32(t.Nanosecond()),
+	}
+}
+
 type Fattr struct {
 	Type                uint32
 	FileMode            uint32
@@ -114,8 +148,36 @@ func (f *Fattr) Size() int64 {
 	return int64(f.Filesize)
 }
 
+// Mode returns the permission bits of the object along with the os.FileMode
+// bits for its type, so that symlinks, devices and the like can be told apart.
 func (f *Fattr) Mode() os.FileMode {
-	return os.FileMode(f.FileMode)
+	mode := os.FileMode(f.FileMode).Perm()
+	if f.FileMode&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if f.FileMode&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if f.FileMode&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+
+	switch f.Type {
+	case NF3Dir:
+		mode |= os.ModeDir
+	case NF3Blk:
+		mode |= os.ModeDevice
+	case NF3Chr:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case NF3Lnk:
+		mode |= os.ModeSymlink
+	case NF3Sock:
+		mode |= os.ModeSocket
+	case NF3FIFO:
+		mode |= os.ModeNamedPipe
+	}
+
+	return mode
 }
 
 func (f *Fattr) ModTime() time.Time {
@@ -130,6 +192,61 @@ func (f *Fattr) Sys() interface{} {
 	return nil
 }
 
+// Rdev returns the device number of a block or character special file, in the
+// encoding returned by Mkdev.
+func (f *Fattr) Rdev() uint64 {
+	return Mkdev(f.Major(), f.Minor())
+}
+
+// Major returns the major device number of a block or character special file
+func (f *Fattr) Major() uint32 {
+	return f.SpecData[0]
+}
+
+// Minor returns the minor device number of a block or character special file
+func (f *Fattr) Minor() uint32 {
+	return f.SpecData[1]
+}
+
+// Mkdev returns a device number from its major and minor parts, using the
+// same encoding as Linux (and golang.org/x/sys/unix).
+func Mkdev(major, minor uint32) uint64 {
+	dev := (uint64(major) & 0x00000fff) << 8
+	dev |= (uint64(major) & 0xfffff000) << 32
+	dev |= (uint64(minor) & 0x000000ff) << 0
+	dev |= (uint64(minor) & 0xffffff00) << 12
+	return dev
+}
+
+// Major returns the major part of a device number built by Mkdev
+func Major(dev uint64) uint32 {
+	major := uint32((dev & 0x00000000000fff00) >> 8)
+	major |= uint32((dev & 0xfffff00000000000) >> 32)
+	return major
+}
+
+// Minor returns the minor part of a device number built by Mkdev
+func Minor(dev uint64) uint32 {
+	minor := uint32((dev & 0x00000000000000ff) >> 0)
+	minor |= uint32((dev & 0x00000ffffff00000) >> 12)
+	return minor
+}
+
+// FileInfo is the os.FileInfo returned by Stat.  It carries the name of the
+// object along with its attributes, which are returned by Sys().
+type FileInfo struct {
+	Fattr
+	name string
+}
+
+func (fi *FileInfo) Name() string {
+	return fi.name
+}
+
+func (fi *FileInfo) Sys() interface{} {
+	return &fi.Fattr
+}
+
 type PostOpFH3 struct {
 	IsSet bool   `xdr:"union"`
 	FH    []byte `xdr:"unioncase=1"`
@@ -217,9 +334,41 @@ type FSInfo struct {
 	Properties uint32
 }
 
-// Dial an RPC svc after getting the port from the portmapper
+// FSStat is the volatile file system state returned by FSSTAT.  Byte counts
+// are in bytes, and the A* fields are what is available to the credential of
+// the caller.
+type FSStat struct {
+	Attr     PostOpAttr
+	TBytes   uint64
+	FBytes   uint64
+	ABytes   uint64
+	TFiles   uint64
+	FFiles   uint64
+	AFiles   uint64
+	Invarsec uint32
+}
+
+// PathConf is the POSIX information about a file system returned by PATHCONF
+type PathConf struct {
+	Attr            PostOpAttr
+	LinkMax         uint32
+	NameMax         uint32
+	NoTrunc         bool
+	ChownRestricted bool
+	CaseInsensitive bool
+	CasePreserving  bool
+}
+
+// Dial an RPC svc after getting the port from the portmapper.  The service,
+// and the portmapper, are reached over UDP if prog.Prot is IPProtoUDP, and
+// over TCP otherwise.
 func DialService(addr string, prog rpc.Mapping) (*rpc.Client, error) {
-	pm, err := rpc.DialPortmapper("tcp", addr)
+	network := "tcp"
+	if prog.Prot == rpc.IPProtoUDP {
+		network = "udp"
+	}
+
+	pm, err := rpc.DialPortmapper(network, addr)
 	if err != nil {
 		util.Errorf("Failed to connect to portmapper: %s", err)
 		return nil, err
@@ -231,7 +380,7 @@ func DialService(addr string, prog rpc.Mapping) (*rpc.Client, error) {
 		return nil, err
 	}
 
-	client, err := dialService(addr, port)
+	client, err := dialService(network, addr, port)
 	if err != nil {
 		return nil, err
 	}
@@ -239,9 +388,10 @@ func DialService(addr string, prog rpc.Mapping) (*rpc.Client, error) {
 	return client, nil
 }
 
-func dialService(addr string, port int) (*rpc.Client, error) {
+// dialService connects from a random privileged port, as servers may refuse
+// requests from others
+func dialService(network string, addr string, port int) (*rpc.Client, error) {
 	var (
-		ldr    *net.TCPAddr
 		client *rpc.Client
 		err    error
 	)
@@ -255,14 +405,15 @@ func dialService(addr string, port int) (*rpc.Client, error) {
 			continue
 		}
 
-		ldr = &net.TCPAddr{
-			Port: p,
-		}
-
 		raddr := fmt.Sprintf("%s:%d", addr, port)
-		util.Debugf("Connecting to %s", raddr)
+		util.Debugf("Connecting to %s over %s", raddr, network)
+
+		if network == "udp" {
+			client, err = rpc.DialUDP(network, &net.UDPAddr{Port: p}, raddr)
+		} else {
+			client, err = rpc.DialTCP(network, &net.TCPAddr{Port: p}, raddr)
+		}
 
-		client, err = rpc.DialTCP("tcp", ldr, raddr)
 		if err == nil {
 			break
 		}
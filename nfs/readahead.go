@@ -0,0 +1,211 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+package nfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// minReadAhead is the window read-ahead starts with, and goes back to when
+// the file is read out of order
+const minReadAhead = 2
+
+// readAhead keeps READs for the data after the current offset in flight, so
+// that sequential reads are not bound by the round trip time
+type readAhead struct {
+	mu sync.Mutex
+
+	// offset the next Read is expected at, and the offset of the next READ
+	// to send
+	pos, next uint64
+
+	// READs in flight or not consumed yet, in offset order
+	chunks []*raChunk
+
+	// number of READs to keep in flight, between minReadAhead and max.  It
+	// grows as long as Read has to wait for READs.
+	window, max int
+
+	// chunks consumed since the window last grew
+	consumed int
+
+	// a READ reported the end of the file, so none are sent after it
+	eof bool
+}
+
+// raChunk is a single READ of the read-ahead
+type raChunk struct {
+	buf  []byte
+	n    int
+	eof  bool
+	err  error
+	done chan struct{}
+
+	// bytes of buf already returned by Read
+	read int
+}
+
+// SetReadAhead turns on read-ahead for sequential Reads, keeping up to
+// window READs of RTPref bytes in flight.  The window starts small and grows
+// while Read has to wait for the server; a Seek or a Read at a different
+// offset empties it and starts over.  A window of 0 turns read-ahead off.
+// ReadAt does not use read-ahead.
+func (f *File) SetReadAhead(window int) {
+	if f.ra != nil {
+		f.ra.mu.Lock()
+		f.ra.reset(0)
+		f.ra.mu.Unlock()
+	}
+
+	if window <= 0 {
+		f.ra = nil
+		return
+	}
+
+	f.ra = &readAhead{max: window}
+	f.ra.reset(f.curr)
+}
+
+// invalidateReadAhead drops the data read ahead, as the file was changed
+// through f
+func (f *File) invalidateReadAhead() {
+	if f.ra == nil {
+		return
+	}
+
+	f.ra.mu.Lock()
+	defer f.ra.mu.Unlock()
+
+	f.ra.reset(f.ra.pos)
+}
+
+// reset drops the READs in flight and starts reading ahead from pos with the
+// smallest window.  READs still in flight complete into buffers nobody
+// looks at.
+func (ra *readAhead) reset(pos uint64) {
+	ra.pos, ra.next = pos, pos
+	ra.chunks = nil
+	ra.window = minInt(minReadAhead, ra.max)
+	ra.consumed = 0
+	ra.eof = false
+}
+
+// restart drops the READs in flight, but keeps the window, as the file is
+// still being read sequentially
+func (ra *readAhead) restart() {
+	ra.next = ra.pos
+	ra.chunks = nil
+	ra.eof = false
+}
+
+// fill sends READs with ctx until the window is full
+func (ra *readAhead) fill(ctx context.Context, f *File) {
+	size := f.readSize()
+	for !ra.eof && len(ra.chunks) < ra.window {
+		c := &raChunk{
+			buf:  make([]byte, size),
+			done: make(chan struct{}),
+		}
+
+		go func(offset uint64) {
+			defer close(c.done)
+			c.n, c.eof, c.err = f.readAt(ctx, c.buf, offset)
+		}(ra.next)
+
+		ra.chunks = append(ra.chunks, c)
+		ra.next += uint64(size)
+	}
+}
+
+// read fills p from the read-ahead, the same way readFull does from
+// individual READs.  The READs it sends are bound by ctx; those a later Read
+// finds canceled by the context of an earlier one are sent again.
+func (ra *readAhead) read(ctx context.Context, f *File, p []byte) (int, error) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	if ra.pos != f.curr {
+		ra.reset(f.curr)
+	}
+
+	// the file may have grown since a READ reported the end of it
+	if ra.eof && len(ra.chunks) == 0 {
+		ra.eof = false
+	}
+
+	n := 0
+	for n < len(p) {
+		ra.fill(ctx, f)
+		if len(ra.chunks) == 0 {
+			return n, io.EOF
+		}
+
+		c := ra.chunks[0]
+		select {
+		case <-c.done:
+		default:
+			// the server is the bottleneck, so more READs in flight help
+			select {
+			case <-c.done:
+			case <-ctx.Done():
+				return n, ctx.Err()
+			}
+
+			if ra.consumed++; ra.consumed >= ra.window && ra.window < ra.max {
+				ra.window = minInt(2*ra.window, ra.max)
+				ra.consumed = 0
+			}
+		}
+
+		if c.err != nil && ctx.Err() == nil && isContextError(c.err) {
+			ra.restart()
+			continue
+		}
+
+		if c.err != nil {
+			ra.reset(ra.pos)
+			return n, c.err
+		}
+
+		m := copy(p[n:], c.buf[c.read:c.n])
+		c.read += m
+		n += m
+		ra.pos += uint64(m)
+
+		if c.read < c.n {
+			continue
+		}
+
+		ra.chunks = ra.chunks[1:]
+		switch {
+		case c.eof:
+			// nothing after the end of the file is worth keeping
+			ra.chunks = nil
+			ra.eof = true
+		case c.n == 0:
+			ra.reset(ra.pos)
+			return n, io.ErrNoProgress
+		case c.n < len(c.buf):
+			// a short READ, so the next ones in flight are at the wrong
+			// offsets
+			ra.restart()
+		}
+	}
+
+	return n, nil
+}
+
+// isContextError reports whether err is that of a context that is done
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+func minInt(x, y int) int {
+	if x > y {
+		return y
+	}
+	return x
+}
@@ -5,10 +5,13 @@ package rpc
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"net"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -34,6 +37,12 @@ const (
 	RpcMismatch = iota
 )
 
+var (
+	ErrProgUnavail  = errors.New("rpc: PROG_UNAVAIL - server does not recognize the program number")
+	ErrProgMismatch = errors.New("rpc: PROG_MISMATCH - program version does not exist on the server")
+	ErrProcUnavail  = errors.New("rpc: PROC_UNAVAIL - unrecognized procedure number")
+)
+
 var xid uint32
 
 func init() {
@@ -41,8 +50,74 @@ func init() {
 	xid = rand.New(rand.NewSource(time.Now().UnixNano())).Uint32()
 }
 
+// Client makes calls over a connection.  It is safe for concurrent use, and
+// any number of calls can be in flight: a single goroutine reads the replies
+// and hands each one to the caller waiting for its XID.  See Reconnect for
+// replacing the connection when it is lost.
 type Client struct {
-	*tcpTransport
+	mu   sync.Mutex
+	conn *conn
+
+	// how long a call waits for its reply, see SetTimeout
+	timeout time.Duration
+
+	// set by Close, after which the connection is not replaced
+	closed bool
+
+	// redialing the connection, see Reconnect
+	dial       func() (*Client, error)
+	idempotent func(Header) bool
+	backoff    Backoff
+
+	// closed when the redial in progress, if any, is over
+	redialing chan struct{}
+}
+
+// conn is a connection of a Client, with the calls waiting for replies on it
+type conn struct {
+	transport
+
+	mu      sync.Mutex
+	pending map[uint32]chan reply
+
+	// set once the connection failed, for calls made after that
+	err error
+}
+
+type reply struct {
+	res io.ReadSeeker
+	err error
+}
+
+// transport sends calls and receives replies over a connection
+type transport interface {
+	Write(call []byte) (int, error)
+	Close() error
+	SetTimeout(d time.Duration)
+
+	// recv returns the next reply, in whatever order they come
+	recv() (io.ReadSeeker, error)
+
+	// retransmit returns how long to wait for a reply before sending a
+	// call again, or 0 if the transport is reliable
+	retransmit() time.Duration
+
+	// maxPayload returns the largest call or reply the transport can carry,
+	// or 0 if there is no limit
+	maxPayload() int
+}
+
+func newClient(t transport) *Client {
+	cn := &conn{
+		transport: t,
+		pending:   make(map[uint32]chan reply),
+	}
+
+	go cn.readReplies()
+	return &Client{
+		conn:    cn,
+		backoff: DefaultBackoff,
+	}
 }
 
 func DialTCP(network string, ldr *net.TCPAddr, addr string) (*Client, error) {
@@ -56,12 +131,49 @@ func DialTCP(network string, ldr *net.TCPAddr, addr string) (*Client, error) {
 		return nil, err
 	}
 
+	// notice a server that went away without closing the connection, as
+	// after a crash or a partition, even while no call is in flight
+	conn.SetKeepAlive(true)
+	conn.SetKeepAlivePeriod(tcpKeepAlive)
+
 	t := &tcpTransport{
 		r:  bufio.NewReader(conn),
 		wc: conn,
 	}
 
-	return &Client{t}, nil
+	return newClient(t), nil
+}
+
+// SetTimeout bounds how long each call waits for its reply.  0, the
+// default, waits forever.  Over TCP, a server does not drop calls, so when the
+// Client redials (see Reconnect) a call that times out is taken to mean the
+// connection is dead, and it is replaced.
+func (c *Client) SetTimeout(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.timeout = d
+	c.conn.SetTimeout(d)
+}
+
+// MaxPayload returns the largest call or reply the connection can carry, or
+// 0 if there is no limit, as for TCP.  Over UDP, it bounds the size of READs
+// and WRITEs.
+func (c *Client) MaxPayload() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.conn.maxPayload()
+}
+
+// Close closes the connection.  Calls in flight fail, and the connection is
+// not redialed.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	return c.conn.Close()
 }
 
 type message struct {
@@ -71,6 +183,13 @@ type message struct {
 }
 
 func (c *Client) Call(call interface{}) (io.ReadSeeker, error) {
+	return c.CallContext(context.Background(), call)
+}
+
+// CallContext is like Call, but gives up waiting for the reply once ctx is
+// done.  The reply is then dropped when it arrives, so the connection stays
+// usable; the call may still have been carried out by the server.
+func (c *Client) CallContext(ctx context.Context, call interface{}) (io.ReadSeeker, error) {
 	retries := 1
 
 	msg := &message{
@@ -84,11 +203,7 @@ retry:
 		return nil, err
 	}
 
-	if _, err := c.Write(w.Bytes()); err != nil {
-		return nil, err
-	}
-
-	res, err := c.recv()
+	res, err := c.roundTrip(ctx, msg.Xid, w.Bytes(), headerOf(call))
 	if err != nil {
 		return nil, err
 	}
@@ -141,11 +256,11 @@ retry:
 		case Success:
 			return res, nil
 		case ProgUnavail:
-			return nil, fmt.Errorf("rpc: PROG_UNAVAIL - server does not recognize the program number")
+			return nil, ErrProgUnavail
 		case ProgMismatch:
-			return nil, fmt.Errorf("rpc: PROG_MISMATCH - program version does not exist on the server")
+			return nil, ErrProgMismatch
 		case ProcUnavail:
-			return nil, fmt.Errorf("rpc: PROC_UNAVAIL - unrecognized procedure number")
+			return nil, ErrProcUnavail
 		case GarbageArgs:
 			// emulate Linux behaviour for GARBAGE_ARGS
 			if retries > 0 {
@@ -176,3 +291,188 @@ retry:
 
 	panic("unreachable")
 }
+
+// roundTrip sends the encoded call on the current connection and waits for
+// the reply.  If the connection is lost and can be redialed, the call is sent
+// again on the new one, unless it already went out and is not idempotent.
+func (c *Client) roundTrip(ctx context.Context, xid uint32, call []byte, hdr *Header) (io.ReadSeeker, error) {
+	for {
+		cn, timeout, err := c.current(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		res, sent, err := cn.roundTrip(ctx, xid, call, timeout)
+
+		var te *timeoutError
+		if errors.As(err, &te) && cn.retransmit() == 0 && c.redials() {
+			err = cn.fail(err)
+		}
+
+		if err == nil || !cn.lost(err) || !c.redials() {
+			return res, err
+		}
+
+		if sent && !c.isIdempotent(hdr) {
+			return nil, &ConnectionLostError{Header: hdr, Err: err}
+		}
+
+		util.Debugf("rpc: connection lost, sending xid %x again: %s", xid, err)
+	}
+}
+
+// roundTrip sends the encoded call and waits for the reply with the same xid.
+// sent reports whether the call may have reached the server.
+func (cn *conn) roundTrip(ctx context.Context, xid uint32, call []byte, timeout time.Duration) (res io.ReadSeeker, sent bool, err error) {
+	// not sent at all, rather than abandoned
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+
+	ch := make(chan reply, 1)
+
+	cn.mu.Lock()
+	if cn.err != nil {
+		cn.mu.Unlock()
+		return nil, false, cn.err
+	}
+	cn.pending[xid] = ch
+	cn.mu.Unlock()
+
+	if _, err := cn.Write(call); err != nil {
+		cn.abandon(xid)
+		cn.fail(err)
+		return nil, true, err
+	}
+
+	var expired <-chan time.Time
+	if timeout != 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	// over an unreliable transport, the call is sent again if no reply comes
+	// in time, backing off exponentially
+	interval := cn.retransmit()
+	for {
+		var resend <-chan time.Time
+		if interval > 0 {
+			resend = time.After(interval)
+		}
+
+		select {
+		case r := <-ch:
+			return r.res, true, r.err
+		case <-expired:
+			cn.abandon(xid)
+			return nil, true, &timeoutError{xid: xid, timeout: timeout}
+		case <-ctx.Done():
+			cn.abandon(xid)
+			return nil, true, ctx.Err()
+		case <-resend:
+			util.Debugf("rpc: no reply to xid %x after %s, retransmitting", xid, interval)
+			if _, err := cn.Write(call); err != nil {
+				cn.abandon(xid)
+				cn.fail(err)
+				return nil, true, err
+			}
+
+			if interval *= 2; interval > maxRetransmit {
+				interval = maxRetransmit
+			}
+		}
+	}
+}
+
+// timeoutError is returned for a call that got no reply within the timeout
+// of the Client
+type timeoutError struct {
+	xid     uint32
+	timeout time.Duration
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("rpc: no reply to xid %x within %s", e.xid, e.timeout)
+}
+
+// abandon stops waiting for the reply to xid, which is dropped if it comes
+func (cn *conn) abandon(xid uint32) {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+
+	delete(cn.pending, xid)
+}
+
+// lost reports whether err is the failure of the connection, rather than of
+// a single call
+func (cn *conn) lost(err error) bool {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+
+	return cn.err != nil && err == cn.err
+}
+
+// failed reports whether the connection failed or was closed
+func (cn *conn) failed() bool {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+
+	return cn.err != nil
+}
+
+// readReplies reads the replies from the connection and dispatches them by
+// xid, until the connection fails or is closed.  The calls in flight then
+// fail with the same error.
+func (cn *conn) readReplies() {
+	for {
+		res, err := cn.recv()
+		if err != nil {
+			cn.fail(err)
+			return
+		}
+
+		xid, err := xdr.ReadUint32(res)
+		if err != nil {
+			cn.fail(err)
+			return
+		}
+
+		if _, err = res.Seek(0, io.SeekStart); err != nil {
+			cn.fail(err)
+			return
+		}
+
+		cn.mu.Lock()
+		ch, ok := cn.pending[xid]
+		delete(cn.pending, xid)
+		cn.mu.Unlock()
+
+		if !ok {
+			util.Debugf("rpc: dropping reply to unknown xid %x", xid)
+			continue
+		}
+
+		ch <- reply{res: res}
+	}
+}
+
+// fail fails the calls in flight and any later ones with err, and closes the
+// connection.  Only the first failure counts, and is returned.
+func (cn *conn) fail(err error) error {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+
+	if cn.err != nil {
+		return cn.err
+	}
+
+	cn.err = err
+	cn.Close()
+	for xid, ch := range cn.pending {
+		ch <- reply{err: err}
+		delete(cn.pending, xid)
+	}
+
+	return err
+}
@@ -0,0 +1,394 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+package rpc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zesagata/go-nfs-client/nfs/xdr"
+)
+
+type echoCall struct {
+	Header
+	Val uint32
+}
+
+// serveEcho reads batch calls at a time from the connections to l, and
+// replies to each batch in reverse order with the Val of each call, so that
+// replies never come in the order of the calls.
+func serveEcho(t *testing.T, l net.Listener, batch int) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			r := bufio.NewReader(conn)
+			for {
+				var replies [][]byte
+				for len(replies) < batch {
+					var hdr uint32
+					if err := binary.Read(r, binary.BigEndian, &hdr); err != nil {
+						return
+					}
+
+					buf := make([]byte, hdr&0x7fffffff)
+					if _, err := io.ReadFull(r, buf); err != nil {
+						return
+					}
+
+					var call struct {
+						Xid     uint32
+						Msgtype uint32
+						Call    echoCall
+					}
+					if err := xdr.Read(bytes.NewReader(buf), &call); err != nil {
+						t.Errorf("decode call: %s", err)
+						return
+					}
+
+					w := new(bytes.Buffer)
+					for _, word := range []uint32{call.Xid, 1, MsgAccepted, 0, 0, Success, call.Call.Val} {
+						xdr.Write(w, word)
+					}
+					replies = append(replies, w.Bytes())
+				}
+
+				for i := len(replies) - 1; i >= 0; i-- {
+					b := make([]byte, 4)
+					binary.BigEndian.PutUint32(b, uint32(len(replies[i]))|0x80000000)
+					if _, err := conn.Write(append(b, replies[i]...)); err != nil {
+						return
+					}
+				}
+			}
+		}()
+	}
+}
+
+func dialEcho(t *testing.T, batch int) *Client {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go serveEcho(t, l, batch)
+
+	c, err := DialTCP("tcp", nil, l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	return c
+}
+
+func echo(c *Client, val uint32) (uint32, error) {
+	res, err := c.Call(&echoCall{
+		Header: Header{Rpcvers: 2, Cred: AuthNull, Verf: AuthNull},
+		Val:    val,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return xdr.ReadUint32(res)
+}
+
+func TestConcurrentCalls(t *testing.T) {
+	const calls = 64
+	c := dialEcho(t, 8)
+
+	var wg sync.WaitGroup
+	for i := uint32(0); i < calls; i++ {
+		wg.Add(1)
+		go func(val uint32) {
+			defer wg.Done()
+
+			got, err := echo(c, val)
+			if err != nil || got != val {
+				t.Errorf("call %d: got %d, %v", val, got, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestCallsFailWithConnection(t *testing.T) {
+	// never replies, as the batch is never complete
+	c := dialEcho(t, 1000)
+
+	errs := make(chan error)
+	go func() {
+		_, err := echo(c, 1)
+		errs <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	c.Close()
+
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Fatalf("call in flight succeeded on a closed client")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("call in flight did not fail when the client was closed")
+	}
+
+	if _, err := echo(c, 2); err == nil {
+		t.Fatalf("call on a closed client succeeded")
+	}
+}
+
+func TestCallTimeout(t *testing.T) {
+	c := dialEcho(t, 2)
+	c.SetTimeout(20 * time.Millisecond)
+
+	if _, err := echo(c, 1); err == nil {
+		t.Fatalf("expected the call to time out")
+	}
+
+	// the reply to the abandoned call comes with this one, and is dropped
+	if got, err := echo(c, 2); err != nil || got != 2 {
+		t.Fatalf("call after a timeout: got %d, %v", got, err)
+	}
+}
+
+func TestCallContext(t *testing.T) {
+	c := dialEcho(t, 2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.CallContext(ctx, &echoCall{}); err != context.Canceled {
+		t.Fatalf("call with a canceled context: expected context.Canceled, got %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := c.CallContext(ctx, &echoCall{Val: 1}); err != context.DeadlineExceeded {
+		t.Fatalf("call past its deadline: expected context.DeadlineExceeded, got %v", err)
+	}
+
+	// the abandoned call did not disturb the connection
+	if got, err := echo(c, 2); err != nil || got != 2 {
+		t.Fatalf("call after a canceled one: got %d, %v", got, err)
+	}
+}
+
+// serveUDPEcho replies to calls with their Val, ignoring the first
+// transmission of every call and sending every reply twice
+func serveUDPEcho(t *testing.T, conn *net.UDPConn) {
+	seen := make(map[uint32]bool)
+	buf := make([]byte, udpMaxDatagram)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		var call struct {
+			Xid     uint32
+			Msgtype uint32
+			Call    echoCall
+		}
+		if err := xdr.Read(bytes.NewReader(buf[:n]), &call); err != nil {
+			t.Errorf("decode call: %s", err)
+			return
+		}
+
+		if !seen[call.Xid] {
+			seen[call.Xid] = true
+			continue
+		}
+
+		w := new(bytes.Buffer)
+		for _, word := range []uint32{call.Xid, 1, MsgAccepted, 0, 0, Success, call.Call.Val} {
+			xdr.Write(w, word)
+		}
+
+		conn.WriteToUDP(w.Bytes(), from)
+		conn.WriteToUDP(w.Bytes(), from)
+	}
+}
+
+func TestUDP(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go serveUDPEcho(t, conn)
+
+	c, err := DialUDP("udp", nil, conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	if c.MaxPayload() == 0 {
+		t.Fatalf("expected a payload limit over UDP")
+	}
+
+	var wg sync.WaitGroup
+	for i := uint32(0); i < 8; i++ {
+		wg.Add(1)
+		go func(val uint32) {
+			defer wg.Done()
+
+			got, err := echo(c, val)
+			if err != nil || got != val {
+				t.Errorf("call %d: got %d, %v", val, got, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestUDPRecv(t *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	conn, err := net.DialUDP("udp", nil, server.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+
+	tr := &udpTransport{conn: conn}
+	t.Cleanup(func() { tr.Close() })
+
+	to := conn.LocalAddr().(*net.UDPAddr)
+	server.WriteToUDP([]byte("first reply"), to)
+	server.WriteToUDP([]byte("second"), to)
+
+	// each reply is its own copy of the datagram, not the read buffer
+	var replies []io.ReadSeeker
+	for i := 0; i < 2; i++ {
+		r, err := tr.recv()
+		if err != nil {
+			t.Fatalf("recv: %s", err)
+		}
+		replies = append(replies, r)
+	}
+
+	for i, want := range []string{"first reply", "second"} {
+		got, _ := io.ReadAll(replies[i])
+		if string(got) != want {
+			t.Fatalf("reply %d: expected %q, got %q", i, want, got)
+		}
+	}
+}
+
+// closeOnCall closes conn once it receives a call
+func closeOnCall(conn net.Conn) {
+	conn.Read(make([]byte, 4))
+	conn.Close()
+}
+
+// hangOnCall reads the calls on conn but never replies, as a server that went
+// away without closing the connection
+func hangOnCall(conn net.Conn) {
+	io.Copy(io.Discard, conn)
+}
+
+// dialFlaky is like dialEcho, but the first connection is handled by first
+// instead, and c redials it
+func dialFlaky(t *testing.T, idempotent bool, first func(net.Conn)) *Client {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		go first(conn)
+		serveEcho(t, l, 1)
+	}()
+
+	dial := func() (*Client, error) {
+		return DialTCP("tcp", nil, l.Addr().String())
+	}
+
+	c, err := dial()
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	c.Reconnect(dial, func(Header) bool { return idempotent })
+	c.SetBackoff(Backoff{Initial: time.Millisecond, Attempts: 3})
+
+	return c
+}
+
+func TestReconnect(t *testing.T) {
+	c := dialFlaky(t, true, closeOnCall)
+
+	// sent again on the new connection
+	if got, err := echo(c, 1); err != nil || got != 1 {
+		t.Fatalf("call across a reconnect: got %d, %v", got, err)
+	}
+}
+
+func TestReconnectNotIdempotent(t *testing.T) {
+	c := dialFlaky(t, false, closeOnCall)
+
+	_, err := echo(c, 1)
+	var lost *ConnectionLostError
+	if !errors.As(err, &lost) {
+		t.Fatalf("expected a ConnectionLostError, got %v", err)
+	}
+
+	// the next call goes on a new connection
+	if got, err := echo(c, 2); err != nil || got != 2 {
+		t.Fatalf("call after a lost connection: got %d, %v", got, err)
+	}
+}
+
+func TestReconnectOnTimeout(t *testing.T) {
+	c := dialFlaky(t, true, hangOnCall)
+	c.SetTimeout(50 * time.Millisecond)
+
+	// the connection that timed out is replaced, and the call sent again
+	if got, err := echo(c, 1); err != nil || got != 1 {
+		t.Fatalf("call across a timeout: got %d, %v", got, err)
+	}
+
+	c = dialFlaky(t, false, hangOnCall)
+	c.SetTimeout(50 * time.Millisecond)
+
+	_, err := echo(c, 1)
+	var (
+		lost *ConnectionLostError
+		te   *timeoutError
+	)
+	if !errors.As(err, &lost) || !errors.As(err, &te) {
+		t.Fatalf("expected a ConnectionLostError for the timeout, got %v", err)
+	}
+
+	if got, err := echo(c, 2); err != nil || got != 2 {
+		t.Fatalf("call after a timeout: got %d, %v", got, err)
+	}
+}
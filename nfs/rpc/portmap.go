@@ -4,6 +4,7 @@ package rpc
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/zesagata/go-nfs-client/nfs/xdr"
 )
@@ -70,8 +71,21 @@ func (p *Portmapper) Getport(mapping Mapping) (int, error) {
 	return int(port), nil
 }
 
+// DialPortmapper connects to the portmapper of host, over UDP if net is
+// "udp", "udp4" or "udp6" and over TCP otherwise
 func DialPortmapper(net, host string) (*Portmapper, error) {
-	client, err := DialTCP(net, nil, fmt.Sprintf("%s:%d", host, PmapPort))
+	var (
+		client *Client
+		err    error
+	)
+
+	addr := fmt.Sprintf("%s:%d", host, PmapPort)
+	if strings.HasPrefix(net, "udp") {
+		client, err = DialUDP(net, nil, addr)
+	} else {
+		client, err = DialTCP(net, nil, addr)
+	}
+
 	if err != nil {
 		return nil, err
 	}
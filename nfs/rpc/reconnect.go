@@ -0,0 +1,181 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/zesagata/go-nfs-client/nfs/util"
+)
+
+// Backoff is how a Client redials a lost connection: it waits Initial before
+// the second attempt, twice as long before each one after that up to Max, and
+// gives up after Attempts dials, or never if Attempts is 0.
+type Backoff struct {
+	Initial  time.Duration
+	Max      time.Duration
+	Attempts int
+}
+
+// DefaultBackoff gives up on a connection after about half a minute
+var DefaultBackoff = Backoff{
+	Initial:  100 * time.Millisecond,
+	Max:      10 * time.Second,
+	Attempts: 10,
+}
+
+var errClosed = errors.New("rpc: client is closed")
+
+// ConnectionLostError is returned for a call that is not idempotent when the
+// connection is lost after it was sent.  The server may or may not have
+// carried it out, so it is not sent again; the connection is redialed for the
+// next calls.
+type ConnectionLostError struct {
+	// the header of the call, if known
+	Header *Header
+	Err    error
+}
+
+func (e *ConnectionLostError) Error() string {
+	if e.Header == nil {
+		return fmt.Sprintf("rpc: connection lost during call: %s", e.Err)
+	}
+
+	return fmt.Sprintf("rpc: connection lost during call to program %d procedure %d: %s",
+		e.Header.Prog, e.Header.Proc, e.Err)
+}
+
+func (e *ConnectionLostError) Unwrap() error {
+	return e.Err
+}
+
+// header gives access to the Header of any call that embeds one
+func (h *Header) header() *Header {
+	return h
+}
+
+func headerOf(call interface{}) *Header {
+	if c, ok := call.(interface{ header() *Header }); ok {
+		return c.header()
+	}
+
+	return nil
+}
+
+// Reconnect makes c replace its connection with one from dial when it is
+// lost, for example when the server restarts.  Calls for which idempotent
+// returns true are then sent again on the new connection; the others fail with
+// a *ConnectionLostError if they were in flight.  dial typically looks up the
+// port of the service again, and the Client it returns is only used for its
+// connection.
+func (c *Client) Reconnect(dial func() (*Client, error), idempotent func(Header) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.dial = dial
+	c.idempotent = idempotent
+}
+
+// SetBackoff sets how c redials a lost connection, DefaultBackoff unless set.
+func (c *Client) SetBackoff(b Backoff) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.backoff = b
+}
+
+// redials reports whether c replaces its connection when it is lost
+func (c *Client) redials() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.dial != nil && !c.closed
+}
+
+func (c *Client) isIdempotent(hdr *Header) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return hdr != nil && c.idempotent != nil && c.idempotent(*hdr)
+}
+
+// current returns the connection to send calls on and their timeout.  If the
+// connection was lost, it is redialed first; only one caller redials, and the
+// others wait for it.
+func (c *Client) current(ctx context.Context) (*conn, time.Duration, error) {
+	c.mu.Lock()
+	for c.redialing != nil {
+		done := c.redialing
+		c.mu.Unlock()
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		}
+
+		c.mu.Lock()
+	}
+
+	if c.dial == nil || c.closed || !c.conn.failed() {
+		defer c.mu.Unlock()
+		return c.conn, c.timeout, nil
+	}
+
+	done := make(chan struct{})
+	c.redialing = done
+	dial, backoff := c.dial, c.backoff
+	c.mu.Unlock()
+
+	cn, err := redial(ctx, dial, backoff)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.redialing = nil
+	close(done)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if c.closed {
+		cn.Close()
+		return nil, 0, errClosed
+	}
+
+	cn.SetTimeout(c.timeout)
+	c.conn = cn
+	return cn, c.timeout, nil
+}
+
+// redial dials a new connection, backing off between attempts
+func redial(ctx context.Context, dial func() (*Client, error), b Backoff) (*conn, error) {
+	delay := b.Initial
+	for attempt := 1; ; attempt++ {
+		client, err := dial()
+		if err == nil {
+			util.Debugf("rpc: redialed after %d attempts", attempt)
+			return client.conn, nil
+		}
+
+		if b.Attempts != 0 && attempt >= b.Attempts {
+			return nil, fmt.Errorf("rpc: giving up redialing after %d attempts: %s", attempt, err)
+		}
+
+		util.Debugf("rpc: redial failed, retrying in %s: %s", delay, err)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		if delay *= 2; b.Max > 0 && delay > b.Max {
+			delay = b.Max
+		}
+	}
+}
@@ -12,6 +12,10 @@ import (
 	"time"
 )
 
+// how often an idle TCP connection is probed to find out whether the server
+// is still there
+const tcpKeepAlive = 30 * time.Second
+
 type tcpTransport struct {
 	r       io.Reader
 	wc      net.Conn
@@ -21,14 +25,11 @@ type tcpTransport struct {
 }
 
 // Get the response from the conn, buffer the contents, and return a reader to
-// it.
+// it.  There is no read deadline, as the connection may be idle between calls;
+// the timeout applies to each call instead.
 func (t *tcpTransport) recv() (io.ReadSeeker, error) {
 	t.rlock.Lock()
 	defer t.rlock.Unlock()
-	if t.timeout != 0 {
-		deadline := time.Now().Add(t.timeout)
-		t.wc.SetReadDeadline(deadline)
-	}
 
 	var hdr uint32
 	if err := binary.Read(t.r, binary.BigEndian, &hdr); err != nil {
@@ -63,6 +64,14 @@ func (t *tcpTransport) Close() error {
 	return t.wc.Close()
 }
 
+func (t *tcpTransport) retransmit() time.Duration {
+	return 0
+}
+
+func (t *tcpTransport) maxPayload() int {
+	return 0
+}
+
 func (t *tcpTransport) SetTimeout(d time.Duration) {
 	t.timeout = d
 	if d == 0 {
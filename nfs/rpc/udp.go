@@ -0,0 +1,117 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+package rpc
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// how long a call over UDP waits before it is first sent again, and the
+	// most it waits between retransmissions
+	udpRetransmit = 500 * time.Millisecond
+	maxRetransmit = 30 * time.Second
+
+	// largest UDP payload over IPv4
+	udpMaxDatagram = 65507
+
+	// largest READ or WRITE over UDP, leaving room in the datagram for the
+	// RPC and NFS headers.  Linux uses the same limit.
+	udpMaxPayload = 32 * 1024
+)
+
+// udpTransport sends each call and reply as a single datagram, without the
+// record marking of tcpTransport.  Datagrams may be lost, duplicated or
+// reordered: Client sends calls again until a reply comes, and drops the
+// replies to calls that are no longer waiting.
+type udpTransport struct {
+	conn    *net.UDPConn
+	timeout time.Duration
+
+	rlock, wlock sync.Mutex
+
+	// the datagram being read, guarded by rlock
+	rbuf []byte
+}
+
+func DialUDP(network string, ldr *net.UDPAddr, addr string) (*Client, error) {
+	a, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialUDP(a.Network(), ldr, a)
+	if err != nil {
+		return nil, err
+	}
+
+	return newClient(&udpTransport{conn: conn}), nil
+}
+
+// Get the next datagram from the conn, and return a reader to a copy of it,
+// so that the read buffer is reused for the next one
+func (t *udpTransport) recv() (io.ReadSeeker, error) {
+	t.rlock.Lock()
+	defer t.rlock.Unlock()
+
+	if t.rbuf == nil {
+		t.rbuf = make([]byte, udpMaxDatagram)
+	}
+
+	for {
+		n, err := t.conn.Read(t.rbuf)
+		if err != nil {
+			// an ICMP port unreachable for an earlier datagram, the
+			// server may come back for the next retransmission
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		return bytes.NewReader(append([]byte(nil), t.rbuf[:n]...)), nil
+	}
+}
+
+func (t *udpTransport) Write(buf []byte) (int, error) {
+	t.wlock.Lock()
+	defer t.wlock.Unlock()
+
+	if len(buf) > udpMaxDatagram {
+		return 0, errors.New("rpc: call too large for a UDP datagram")
+	}
+
+	if t.timeout != 0 {
+		deadline := time.Now().Add(t.timeout)
+		t.conn.SetWriteDeadline(deadline)
+	}
+
+	return t.conn.Write(buf)
+}
+
+func (t *udpTransport) Close() error {
+	return t.conn.Close()
+}
+
+func (t *udpTransport) retransmit() time.Duration {
+	return udpRetransmit
+}
+
+func (t *udpTransport) maxPayload() int {
+	return udpMaxPayload
+}
+
+func (t *udpTransport) SetTimeout(d time.Duration) {
+	t.timeout = d
+	if d == 0 {
+		var zeroTime time.Time
+		t.conn.SetDeadline(zeroTime)
+	}
+}
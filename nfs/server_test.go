@@ -0,0 +1,1056 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+package nfs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/zesagata/go-nfs-client/nfs/rpc"
+	"github.com/zesagata/go-nfs-client/nfs/xdr"
+)
+
+// fakeServer is a minimal in-memory NFSv3 server to test Target against
+type fakeServer struct {
+	t *testing.T
+	l net.Listener
+
+	mu     sync.Mutex
+	nodes  map[uint64]*fakeNode
+	nextID uint64
+
+	// handlers can be overridden by tests to inject faults
+	handlers map[uint32]fakeHandler
+
+	// write verifier, and the UNSTABLE writes since the last COMMIT, which
+	// reboot loses
+	writeVerf uint64
+	unstable  []fakeWrite
+
+	// the number of calls to each procedure on each connection, in the
+	// order they were accepted
+	calls []map[uint32]int
+}
+
+type fakeWrite struct {
+	n      *fakeNode
+	offset uint64
+	count  int
+}
+
+// fakeHandler decodes the arguments of a call from args and returns the
+// encoded result, including the nfsstat3, or nil to close the connection
+// without replying.
+type fakeHandler func(args io.Reader) []byte
+
+type fakeNode struct {
+	attr     Fattr
+	data     []byte
+	parent   uint64
+	children map[string]uint64
+
+	// verifier of an EXCLUSIVE CREATE
+	verf uint64
+}
+
+const fakeRootID = 1
+
+func newFakeServer(t *testing.T) *fakeServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+
+	s := &fakeServer{
+		t:         t,
+		l:         l,
+		nodes:     make(map[uint64]*fakeNode),
+		nextID:    fakeRootID,
+		writeVerf: 0x5eed,
+	}
+
+	s.handlers = map[uint32]fakeHandler{
+		NFSProc3GetAttr:     s.getattr,
+		NFSProc3SetAttr:     s.setattr,
+		NFSProc3Lookup:      s.lookup,
+		NFSProc3Readlink:    s.readlink,
+		NFSProc3Read:        s.read,
+		NFSProc3Write:       s.write,
+		NFSProc3Commit:      s.commit,
+		NFSProc3Create:      s.create,
+		NFSProc3Mkdir:       s.mkdirProc,
+		NFSProc3Remove:      s.remove,
+		NFSProc3RmDir:       s.rmdir,
+		NFSProc3ReadDir:     s.readdir,
+		NFSProc3ReadDirPlus: s.readdirplus,
+		NFSProc3FSInfo:      s.fsinfo,
+		NFSProc3Rename:      s.rename,
+		NFSProc3Symlink:     s.symlinkProc,
+		NFSProc3Link:        s.link,
+		NFSProc3Mknod:       s.mknod,
+		NFSProc3Access:      s.access,
+		NFSProc3FSStat:      s.fsstat,
+		NFSProc3PathConf:    s.pathconf,
+	}
+
+	s.newNode(NF3Dir, 0755, 0)
+
+	go s.serve()
+	t.Cleanup(func() { l.Close() })
+
+	return s
+}
+
+// dial opens a connection to the server
+func (s *fakeServer) dial() (*rpc.Client, error) {
+	client, err := rpc.DialTCP("tcp", nil, s.l.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+
+	client.Reconnect(s.dial, idempotent)
+	return client, nil
+}
+
+// target dials the server and returns a Target for its root
+func (s *fakeServer) target() *Target {
+	client, err := s.dial()
+	if err != nil {
+		s.t.Fatalf("dial: %s", err)
+	}
+
+	v, err := newTarget(context.Background(), client, rpc.AuthNull, fakeFH(fakeRootID), "/export")
+	if err != nil {
+		s.t.Fatalf("target: %s", err)
+	}
+
+	v.dial = s.dial
+
+	s.t.Cleanup(func() { v.Close() })
+	return v
+}
+
+func (s *fakeServer) newNode(ftype uint32, mode uint32, parent uint64) *fakeNode {
+	id := s.nextID
+	s.nextID++
+
+	n := &fakeNode{
+		attr: Fattr{
+			Type:     ftype,
+			FileMode: mode,
+			Nlink:    1,
+			Fileid:   id,
+			Mtime:    NFS3Time{Seconds: 1500000000 + uint32(id)},
+		},
+		parent: parent,
+	}
+
+	if ftype == NF3Dir {
+		n.children = make(map[string]uint64)
+	}
+
+	s.nodes[id] = n
+	return n
+}
+
+// add creates the object at p, and any missing parent directories
+func (s *fakeServer) add(p string, ftype uint32, mode uint32, data string) *fakeNode {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir := s.nodes[fakeRootID]
+	names := splitPath(p)
+	for i, name := range names {
+		if id, ok := dir.children[name]; ok {
+			dir = s.nodes[id]
+			continue
+		}
+
+		if i < len(names)-1 {
+			n := s.newNode(NF3Dir, 0755, dir.attr.Fileid)
+			dir.children[name] = n.attr.Fileid
+			dir = n
+			continue
+		}
+
+		n := s.newNode(ftype, mode, dir.attr.Fileid)
+		n.data = []byte(data)
+		n.attr.Filesize = uint64(len(data))
+		dir.children[name] = n.attr.Fileid
+		return n
+	}
+
+	return dir
+}
+
+func (s *fakeServer) mkdir(p string)                { s.add(p, NF3Dir, 0755, "") }
+func (s *fakeServer) file(p string, data string)    { s.add(p, NF3Reg, 0644, data) }
+func (s *fakeServer) symlink(p string, data string) { s.add(p, NF3Lnk, 0777, data) }
+
+func (s *fakeServer) serve() {
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		calls := make(map[uint32]int)
+		s.calls = append(s.calls, calls)
+		s.mu.Unlock()
+
+		go s.serveConn(conn, calls)
+	}
+}
+
+// serveConn handles the calls on conn concurrently, so replies may be sent
+// out of order, and counts them in calls
+func (s *fakeServer) serveConn(conn net.Conn, calls map[uint32]int) {
+	defer conn.Close()
+
+	var wlock sync.Mutex
+	r := bufio.NewReader(conn)
+	for {
+		var hdr uint32
+		if err := binary.Read(r, binary.BigEndian, &hdr); err != nil {
+			return
+		}
+
+		buf := make([]byte, hdr&0x7fffffff)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return
+		}
+
+		go func() {
+			reply := s.handle(bytes.NewReader(buf), calls)
+			if reply == nil {
+				conn.Close()
+				return
+			}
+
+			b := make([]byte, 4, 4+len(reply))
+			binary.BigEndian.PutUint32(b, uint32(len(reply))|0x80000000)
+
+			wlock.Lock()
+			defer wlock.Unlock()
+			conn.Write(append(b, reply...))
+		}()
+	}
+}
+
+// handle decodes a call, counts it in calls and returns the encoded reply
+func (s *fakeServer) handle(r io.Reader, calls map[uint32]int) []byte {
+	type callHeader struct {
+		Xid     uint32
+		Msgtype uint32
+		rpc.Header
+	}
+
+	var call callHeader
+	if err := xdr.Read(r, &call); err != nil {
+		s.t.Errorf("fake server failed to decode call: %s", err)
+		return nil
+	}
+
+	s.mu.Lock()
+	h, ok := s.handlers[call.Proc]
+	calls[call.Proc]++
+	s.mu.Unlock()
+
+	acceptStat := uint32(rpc.Success)
+	var res []byte
+	if call.Prog != Nfs3Prog {
+		acceptStat = rpc.ProgUnavail
+	} else if !ok {
+		acceptStat = rpc.ProcUnavail
+	} else if res = h(r); res == nil {
+		return nil
+	}
+
+	// xid, REPLY, MSG_ACCEPTED, an AUTH_NULL verifier and the accept_stat
+	w := new(bytes.Buffer)
+	for _, word := range []uint32{call.Xid, 1, rpc.MsgAccepted, 0, 0, acceptStat} {
+		xdr.Write(w, word)
+	}
+
+	return append(w.Bytes(), res...)
+}
+
+// encode returns the nfsstat3 followed by the encoded values
+func encode(status uint32, vals ...interface{}) []byte {
+	w := new(bytes.Buffer)
+	xdr.Write(w, status)
+	for _, val := range vals {
+		xdr.Write(w, val)
+	}
+
+	return w.Bytes()
+}
+
+func fakeFH(id uint64) []byte {
+	fh := make([]byte, 8)
+	binary.BigEndian.PutUint64(fh, id)
+	return fh
+}
+
+// node returns the node of fh, or an error status
+func (s *fakeServer) node(fh []byte) (*fakeNode, uint32) {
+	if len(fh) != 8 {
+		return nil, NFS3ErrBadHandle
+	}
+
+	n, ok := s.nodes[binary.BigEndian.Uint64(fh)]
+	if !ok {
+		return nil, NFS3ErrStale
+	}
+
+	return n, NFS3Ok
+}
+
+func (n *fakeNode) postOpAttr() PostOpAttr {
+	return PostOpAttr{IsSet: true, Attr: n.attr}
+}
+
+func (s *fakeServer) getattr(args io.Reader) []byte {
+	var fh []byte
+	xdr.Read(args, &fh)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, status := s.node(fh)
+	if status != NFS3Ok {
+		return encode(status)
+	}
+
+	return encode(NFS3Ok, n.attr)
+}
+
+// apply sets the attributes in attrs on n
+func (n *fakeNode) apply(attrs Sattr3) {
+	if attrs.Mode.SetIt {
+		n.attr.FileMode = attrs.Mode.Mode
+	}
+
+	if attrs.UID.SetIt {
+		n.attr.UID = attrs.UID.UID
+	}
+
+	if attrs.GID.SetIt {
+		n.attr.GID = attrs.GID.UID
+	}
+
+	if attrs.Size.SetIt {
+		data := make([]byte, attrs.Size.Size)
+		copy(data, n.data)
+		n.data = data
+		n.attr.Filesize = attrs.Size.Size
+	}
+
+	if attrs.Atime.SetIt == SetToClientTime {
+		n.attr.Atime = attrs.Atime.Time
+	}
+
+	if attrs.Mtime.SetIt == SetToClientTime {
+		n.attr.Mtime = attrs.Mtime.Time
+	}
+
+	n.attr.Ctime.Nseconds++
+}
+
+func (s *fakeServer) setattr(args io.Reader) []byte {
+	var setattrArgs struct {
+		FH    []byte
+		Attrs Sattr3
+		Guard struct {
+			Check bool     `xdr:"union"`
+			Ctime NFS3Time `xdr:"unioncase=1"`
+		}
+	}
+	xdr.Read(args, &setattrArgs)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, status := s.node(setattrArgs.FH)
+	if status != NFS3Ok {
+		return encode(status, WccData{})
+	}
+
+	if setattrArgs.Guard.Check && setattrArgs.Guard.Ctime != n.attr.Ctime {
+		return encode(NFS3ErrNotSync, WccData{After: n.postOpAttr()})
+	}
+
+	n.apply(setattrArgs.Attrs)
+	return encode(NFS3Ok, WccData{After: n.postOpAttr()})
+}
+
+func (s *fakeServer) create(args io.Reader) []byte {
+	var createArgs struct {
+		Where Diropargs3
+		Mode  uint32
+	}
+	xdr.Read(args, &createArgs)
+
+	var (
+		attrs Sattr3
+		verf  uint64
+	)
+
+	if createArgs.Mode == createExclusive {
+		xdr.Read(args, &verf)
+	} else {
+		xdr.Read(args, &attrs)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir, status := s.node(createArgs.Where.FH)
+	if status != NFS3Ok {
+		return encode(status, WccData{})
+	}
+
+	if dir.children == nil {
+		return encode(NFS3ErrNotDir, WccData{})
+	}
+
+	if id, ok := dir.children[createArgs.Where.Filename]; ok {
+		n := s.nodes[id]
+		switch {
+		case createArgs.Mode == createUnchecked:
+			n.apply(Sattr3{Size: attrs.Size})
+		case createArgs.Mode == createExclusive && n.verf == verf:
+		default:
+			return encode(NFS3ErrExist, WccData{})
+		}
+
+		return encode(NFS3Ok, PostOpFH3{IsSet: true, FH: fakeFH(id)}, n.postOpAttr(), WccData{})
+	}
+
+	n := s.newNode(NF3Reg, 0, dir.attr.Fileid)
+	n.apply(attrs)
+	n.verf = verf
+	dir.children[createArgs.Where.Filename] = n.attr.Fileid
+
+	return encode(NFS3Ok, PostOpFH3{IsSet: true, FH: fakeFH(n.attr.Fileid)}, n.postOpAttr(), WccData{})
+}
+
+func (s *fakeServer) mkdirProc(args io.Reader) []byte {
+	var mkdirArgs struct {
+		Where Diropargs3
+		Attrs Sattr3
+	}
+	xdr.Read(args, &mkdirArgs)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir, status := s.node(mkdirArgs.Where.FH)
+	if status != NFS3Ok {
+		return encode(status, WccData{})
+	}
+
+	if dir.children == nil {
+		return encode(NFS3ErrNotDir, WccData{})
+	}
+
+	if _, ok := dir.children[mkdirArgs.Where.Filename]; ok {
+		return encode(NFS3ErrExist, WccData{})
+	}
+
+	n := s.newNode(NF3Dir, 0, dir.attr.Fileid)
+	n.apply(mkdirArgs.Attrs)
+	dir.children[mkdirArgs.Where.Filename] = n.attr.Fileid
+
+	return encode(NFS3Ok, PostOpFH3{IsSet: true, FH: fakeFH(n.attr.Fileid)}, n.postOpAttr(), WccData{})
+}
+
+// unlink removes the entry of object, which must be a directory if isDir is
+// set, and must not be one otherwise
+func (s *fakeServer) unlink(args io.Reader, isDir bool) []byte {
+	var object Diropargs3
+	xdr.Read(args, &object)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir, status := s.node(object.FH)
+	if status != NFS3Ok {
+		return encode(status, WccData{})
+	}
+
+	id, ok := dir.children[object.Filename]
+	if !ok {
+		return encode(NFS3ErrNoEnt, WccData{})
+	}
+
+	n := s.nodes[id]
+	switch {
+	case isDir && n.attr.Type != NF3Dir:
+		return encode(NFS3ErrNotDir, WccData{})
+	case !isDir && n.attr.Type == NF3Dir:
+		return encode(NFS3ErrIsDir, WccData{})
+	case len(n.children) != 0:
+		return encode(NFS3ErrNotEmpty, WccData{})
+	}
+
+	delete(dir.children, object.Filename)
+	if n.attr.Nlink--; n.attr.Nlink == 0 || isDir {
+		delete(s.nodes, id)
+	}
+
+	return encode(NFS3Ok, WccData{After: dir.postOpAttr()})
+}
+
+func (s *fakeServer) remove(args io.Reader) []byte { return s.unlink(args, false) }
+func (s *fakeServer) rmdir(args io.Reader) []byte  { return s.unlink(args, true) }
+
+func (s *fakeServer) lookup(args io.Reader) []byte {
+	var what Diropargs3
+	xdr.Read(args, &what)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir, status := s.node(what.FH)
+	if status != NFS3Ok {
+		return encode(status, PostOpAttr{})
+	}
+
+	if dir.children == nil {
+		return encode(NFS3ErrNotDir, dir.postOpAttr())
+	}
+
+	id, ok := dir.children[what.Filename]
+	switch {
+	case what.Filename == ".":
+		id, ok = dir.attr.Fileid, true
+	case what.Filename == ".." && dir.parent != 0:
+		id, ok = dir.parent, true
+	case what.Filename == "..":
+		id, ok = dir.attr.Fileid, true
+	}
+
+	if !ok {
+		return encode(NFS3ErrNoEnt, dir.postOpAttr())
+	}
+
+	return encode(NFS3Ok, fakeFH(id), s.nodes[id].postOpAttr(), dir.postOpAttr())
+}
+
+func (s *fakeServer) readlink(args io.Reader) []byte {
+	var fh []byte
+	xdr.Read(args, &fh)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, status := s.node(fh)
+	if status != NFS3Ok {
+		return encode(status, PostOpAttr{})
+	}
+
+	if n.attr.Type != NF3Lnk {
+		return encode(NFS3ErrInval, n.postOpAttr())
+	}
+
+	return encode(NFS3Ok, n.postOpAttr(), string(n.data))
+}
+
+func (s *fakeServer) read(args io.Reader) []byte {
+	var readArgs struct {
+		FH     []byte
+		Offset uint64
+		Count  uint32
+	}
+	xdr.Read(args, &readArgs)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, status := s.node(readArgs.FH)
+	if status != NFS3Ok {
+		return encode(status, PostOpAttr{})
+	}
+
+	if n.attr.Type == NF3Dir {
+		return encode(NFS3ErrIsDir, n.postOpAttr())
+	}
+
+	start := min64(readArgs.Offset, uint64(len(n.data)))
+	end := min64(start+uint64(readArgs.Count), uint64(len(n.data)))
+	data := n.data[start:end]
+	eof := end == uint64(len(n.data))
+
+	return encode(NFS3Ok, n.postOpAttr(), uint32(len(data)), eof, data)
+}
+
+// reboot loses the data of UNSTABLE writes that were not committed, and
+// changes the write verifier
+func (s *fakeServer) reboot() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, w := range s.unstable {
+		copy(w.n.data[w.offset:], make([]byte, w.count))
+	}
+
+	s.unstable = nil
+	s.writeVerf++
+}
+
+func (s *fakeServer) write(args io.Reader) []byte {
+	var writeArgs struct {
+		FH       []byte
+		Offset   uint64
+		Count    uint32
+		How      uint32
+		Contents []byte
+	}
+	xdr.Read(args, &writeArgs)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, status := s.node(writeArgs.FH)
+	if status != NFS3Ok {
+		return encode(status, WccData{})
+	}
+
+	if n.attr.Type != NF3Reg {
+		return encode(NFS3ErrInval, WccData{After: n.postOpAttr()})
+	}
+
+	end := writeArgs.Offset + uint64(len(writeArgs.Contents))
+	if end > uint64(len(n.data)) {
+		n.data = append(n.data, make([]byte, end-uint64(len(n.data)))...)
+		n.attr.Filesize = end
+	}
+	copy(n.data[writeArgs.Offset:], writeArgs.Contents)
+
+	if writeArgs.How == uint32(Unstable) {
+		s.unstable = append(s.unstable, fakeWrite{n, writeArgs.Offset, len(writeArgs.Contents)})
+	}
+
+	return encode(NFS3Ok, WccData{After: n.postOpAttr()}, uint32(len(writeArgs.Contents)), writeArgs.How, s.writeVerf)
+}
+
+func (s *fakeServer) commit(args io.Reader) []byte {
+	var commitArgs struct {
+		FH     []byte
+		Offset uint64
+		Count  uint32
+	}
+	xdr.Read(args, &commitArgs)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, status := s.node(commitArgs.FH)
+	if status != NFS3Ok {
+		return encode(status, WccData{})
+	}
+
+	s.unstable = nil
+	return encode(NFS3Ok, WccData{After: n.postOpAttr()}, s.writeVerf)
+}
+
+func (s *fakeServer) rename(args io.Reader) []byte {
+	var renameArgs struct {
+		From Diropargs3
+		To   Diropargs3
+	}
+	xdr.Read(args, &renameArgs)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	from, status := s.node(renameArgs.From.FH)
+	if status != NFS3Ok {
+		return encode(status, WccData{}, WccData{})
+	}
+
+	to, status := s.node(renameArgs.To.FH)
+	if status != NFS3Ok {
+		return encode(status, WccData{}, WccData{})
+	}
+
+	if from.children == nil || to.children == nil {
+		return encode(NFS3ErrNotDir, WccData{}, WccData{})
+	}
+
+	id, ok := from.children[renameArgs.From.Filename]
+	if !ok {
+		return encode(NFS3ErrNoEnt, WccData{}, WccData{})
+	}
+
+	n := s.nodes[id]
+	if oldID, ok := to.children[renameArgs.To.Filename]; ok {
+		old := s.nodes[oldID]
+		switch {
+		case (old.attr.Type == NF3Dir) != (n.attr.Type == NF3Dir):
+			return encode(NFS3ErrExist, WccData{}, WccData{})
+		case len(old.children) != 0:
+			return encode(NFS3ErrNotEmpty, WccData{}, WccData{})
+		}
+	}
+
+	delete(from.children, renameArgs.From.Filename)
+	to.children[renameArgs.To.Filename] = id
+	if n.children != nil {
+		n.parent = to.attr.Fileid
+	}
+
+	return encode(NFS3Ok, WccData{After: from.postOpAttr()}, WccData{After: to.postOpAttr()})
+}
+
+func (s *fakeServer) symlinkProc(args io.Reader) []byte {
+	var symlinkArgs struct {
+		Where Diropargs3
+		Attrs Sattr3
+		Data  string
+	}
+	xdr.Read(args, &symlinkArgs)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir, status := s.node(symlinkArgs.Where.FH)
+	if status != NFS3Ok {
+		return encode(status, WccData{})
+	}
+
+	if dir.children == nil {
+		return encode(NFS3ErrNotDir, WccData{})
+	}
+
+	if _, ok := dir.children[symlinkArgs.Where.Filename]; ok {
+		return encode(NFS3ErrExist, WccData{})
+	}
+
+	n := s.newNode(NF3Lnk, 0777, dir.attr.Fileid)
+	n.data = []byte(symlinkArgs.Data)
+	n.attr.Filesize = uint64(len(n.data))
+	dir.children[symlinkArgs.Where.Filename] = n.attr.Fileid
+
+	return encode(NFS3Ok, PostOpFH3{IsSet: true, FH: fakeFH(n.attr.Fileid)}, n.postOpAttr(), WccData{})
+}
+
+func (s *fakeServer) link(args io.Reader) []byte {
+	var linkArgs struct {
+		FH   []byte
+		Link Diropargs3
+	}
+	xdr.Read(args, &linkArgs)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, status := s.node(linkArgs.FH)
+	if status != NFS3Ok {
+		return encode(status, PostOpAttr{}, WccData{})
+	}
+
+	dir, status := s.node(linkArgs.Link.FH)
+	if status != NFS3Ok {
+		return encode(status, PostOpAttr{}, WccData{})
+	}
+
+	if n.attr.Type == NF3Dir {
+		return encode(NFS3ErrIsDir, n.postOpAttr(), WccData{})
+	}
+
+	if dir.children == nil {
+		return encode(NFS3ErrNotDir, n.postOpAttr(), WccData{})
+	}
+
+	if _, ok := dir.children[linkArgs.Link.Filename]; ok {
+		return encode(NFS3ErrExist, n.postOpAttr(), WccData{})
+	}
+
+	dir.children[linkArgs.Link.Filename] = n.attr.Fileid
+	n.attr.Nlink++
+
+	return encode(NFS3Ok, n.postOpAttr(), WccData{})
+}
+
+func (s *fakeServer) mknod(args io.Reader) []byte {
+	var mknodArgs struct {
+		Where Diropargs3
+		Type  uint32
+	}
+	xdr.Read(args, &mknodArgs)
+
+	var (
+		attrs Sattr3
+		spec  [2]uint32
+	)
+
+	switch mknodArgs.Type {
+	case NF3Chr, NF3Blk:
+		xdr.Read(args, &attrs)
+		xdr.Read(args, &spec)
+	case NF3Sock, NF3FIFO:
+		xdr.Read(args, &attrs)
+	default:
+		return encode(NFS3ErrBadType, WccData{})
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir, status := s.node(mknodArgs.Where.FH)
+	if status != NFS3Ok {
+		return encode(status, WccData{})
+	}
+
+	if dir.children == nil {
+		return encode(NFS3ErrNotDir, WccData{})
+	}
+
+	if _, ok := dir.children[mknodArgs.Where.Filename]; ok {
+		return encode(NFS3ErrExist, WccData{})
+	}
+
+	n := s.newNode(mknodArgs.Type, 0, dir.attr.Fileid)
+	n.apply(attrs)
+	n.attr.SpecData = spec
+	dir.children[mknodArgs.Where.Filename] = n.attr.Fileid
+
+	return encode(NFS3Ok, PostOpFH3{IsSet: true, FH: fakeFH(n.attr.Fileid)}, n.postOpAttr(), WccData{})
+}
+
+// access grants what the owner permission bits allow, as if the caller owned
+// every object
+func (s *fakeServer) access(args io.Reader) []byte {
+	var accessArgs struct {
+		FH     []byte
+		Access uint32
+	}
+	xdr.Read(args, &accessArgs)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, status := s.node(accessArgs.FH)
+	if status != NFS3Ok {
+		return encode(status, PostOpAttr{})
+	}
+
+	var granted uint32
+	if n.attr.FileMode&0400 != 0 {
+		granted |= Access3Read
+	}
+	if n.attr.FileMode&0200 != 0 {
+		granted |= Access3Modify | Access3Extend | Access3Delete
+	}
+	if n.attr.FileMode&0100 != 0 {
+		if n.attr.Type == NF3Dir {
+			granted |= Access3Lookup
+		} else {
+			granted |= Access3Execute
+		}
+	}
+
+	return encode(NFS3Ok, n.postOpAttr(), granted&accessArgs.Access)
+}
+
+// entries returns the sorted entries of dir, including "." and ".."
+func (s *fakeServer) entries(dir *fakeNode) []*EntryPlus {
+	names := make([]string, 0, len(dir.children))
+	for name := range dir.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parent := dir.parent
+	if parent == 0 {
+		parent = dir.attr.Fileid
+	}
+
+	ids := append([]uint64{dir.attr.Fileid, parent}, make([]uint64, len(names))...)
+	names = append([]string{".", ".."}, names...)
+
+	entries := make([]*EntryPlus, len(names))
+	for i, name := range names {
+		id := ids[i]
+		if id == 0 {
+			id = dir.children[name]
+		}
+
+		entries[i] = &EntryPlus{
+			FileId:   id,
+			FileName: name,
+			Cookie:   uint64(i + 1),
+			Attr:     s.nodes[id].postOpAttr(),
+			Handle:   PostOpFH3{IsSet: true, FH: fakeFH(id)},
+		}
+	}
+
+	return entries
+}
+
+// page returns the entries of a READDIR(PLUS) reply after cookie, up to
+// count entries
+func (s *fakeServer) page(fh []byte, cookie uint64, count int) ([]*EntryPlus, bool, *fakeNode, uint32) {
+	dir, status := s.node(fh)
+	if status != NFS3Ok {
+		return nil, false, nil, status
+	}
+
+	if dir.children == nil {
+		return nil, false, dir, NFS3ErrNotDir
+	}
+
+	entries := s.entries(dir)
+	if cookie > uint64(len(entries)) {
+		return nil, false, dir, NFS3ErrBadCookie
+	}
+
+	entries = entries[cookie:]
+	eof := len(entries) <= count
+	if !eof {
+		entries = entries[:count]
+	}
+
+	return entries, eof, dir, NFS3Ok
+}
+
+func (s *fakeServer) readdir(args io.Reader) []byte {
+	var readdirArgs struct {
+		FH         []byte
+		Cookie     uint64
+		CookieVerf uint64
+		Count      uint32
+	}
+	xdr.Read(args, &readdirArgs)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// roughly what fits in count bytes
+	entries, eof, dir, status := s.page(readdirArgs.FH, readdirArgs.Cookie, int(readdirArgs.Count/32))
+	if status != NFS3Ok {
+		return encode(status, PostOpAttr{})
+	}
+
+	w := new(bytes.Buffer)
+	w.Write(encode(NFS3Ok, dir.postOpAttr(), uint64(0)))
+	for _, entry := range entries {
+		xdr.Write(w, true)
+		xdr.Write(w, entry.FileId)
+		xdr.Write(w, entry.FileName)
+		xdr.Write(w, entry.Cookie)
+	}
+	xdr.Write(w, false)
+	xdr.Write(w, eof)
+
+	return w.Bytes()
+}
+
+func (s *fakeServer) readdirplus(args io.Reader) []byte {
+	var readdirArgs struct {
+		FH         []byte
+		Cookie     uint64
+		CookieVerf uint64
+		DirCount   uint32
+		MaxCount   uint32
+	}
+	xdr.Read(args, &readdirArgs)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// roughly what fits in maxcount bytes
+	entries, eof, dir, status := s.page(readdirArgs.FH, readdirArgs.Cookie, int(readdirArgs.MaxCount/160))
+	if status != NFS3Ok {
+		return encode(status, PostOpAttr{})
+	}
+
+	w := new(bytes.Buffer)
+	w.Write(encode(NFS3Ok, dir.postOpAttr(), uint64(0)))
+	for _, entry := range entries {
+		xdr.Write(w, true)
+		xdr.Write(w, entry)
+	}
+	xdr.Write(w, false)
+	xdr.Write(w, eof)
+
+	return w.Bytes()
+}
+
+func (s *fakeServer) fsinfo(args io.Reader) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return encode(NFS3Ok, FSInfo{
+		Attr:   s.nodes[fakeRootID].postOpAttr(),
+		RTMax:  64 * 1024,
+		RTPref: 16 * 1024,
+		RTMult: 4096,
+		WTMax:  64 * 1024,
+		WTPref: 16 * 1024,
+		WTMult: 4096,
+		DTPref: 4096,
+		Size:   1 << 40,
+	})
+}
+
+func (s *fakeServer) fsstat(args io.Reader) []byte {
+	var fh []byte
+	xdr.Read(args, &fh)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, status := s.node(fh)
+	if status != NFS3Ok {
+		return encode(status, PostOpAttr{})
+	}
+
+	return encode(NFS3Ok, FSStat{
+		Attr:   n.postOpAttr(),
+		TBytes: 1 << 40,
+		FBytes: 1 << 30,
+		ABytes: 1 << 29,
+		TFiles: 1 << 20,
+		FFiles: 1<<20 - uint64(len(s.nodes)),
+		AFiles: 1<<20 - uint64(len(s.nodes)),
+	})
+}
+
+func (s *fakeServer) pathconf(args io.Reader) []byte {
+	var fh []byte
+	xdr.Read(args, &fh)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, status := s.node(fh)
+	if status != NFS3Ok {
+		return encode(status, PostOpAttr{})
+	}
+
+	return encode(NFS3Ok, PathConf{
+		Attr:           n.postOpAttr(),
+		LinkMax:        32000,
+		NameMax:        255,
+		NoTrunc:        true,
+		CasePreserving: true,
+	})
+}
+
+func min64(x, y uint64) uint64 {
+	if x > y {
+		return y
+	}
+	return x
+}
@@ -3,11 +3,17 @@
 package nfs
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
 	"io"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/zesagata/go-nfs-client/nfs/rpc"
 	"github.com/zesagata/go-nfs-client/nfs/util"
@@ -21,42 +27,132 @@ type Target struct {
 	fh      []byte
 	dirPath string
 	fsinfo  *FSInfo
+
+	// set once the server has refused READDIRPLUS, after which directories
+	// are listed with READDIR (see dir.go)
+	noReadDirPlus uint32
+
+	// sizes of READDIR(PLUS) requests, see SetReadDirSize
+	dirCount, maxCount uint32
+
+	// connections to the NFS service, the embedded Client first, see
+	// SetConnections
+	conns     []*pooledConn
+	connsLock sync.RWMutex
+	nextConn  uint32
+
+	// dials another connection, if the Target knows where the service is
+	dial func() (*rpc.Client, error)
+
+	// settings of every connection
+	timeout time.Duration
+	backoff rpc.Backoff
 }
 
 func NewTarget(addr string, auth rpc.Auth, fh []byte, dirpath string) (*Target, error) {
+	return NewTargetProto(addr, rpc.IPProtoTCP, auth, fh, dirpath)
+}
+
+// NewTargetProto is like NewTarget, but talks to the NFS server over prot,
+// rpc.IPProtoTCP or rpc.IPProtoUDP.  Over UDP, READs, WRITEs and directory
+// listings are limited to what fits in a datagram.
+func NewTargetProto(addr string, prot uint32, auth rpc.Auth, fh []byte, dirpath string) (*Target, error) {
+	return NewTargetProtoContext(context.Background(), addr, prot, auth, fh, dirpath)
+}
+
+// NewTargetProtoContext is NewTargetProto with a context
+func NewTargetProtoContext(ctx context.Context, addr string, prot uint32, auth rpc.Auth, fh []byte, dirpath string) (*Target, error) {
 	m := rpc.Mapping{
 		Prog: Nfs3Prog,
 		Vers: Nfs3Vers,
-		Prot: rpc.IPProtoTCP,
+		Prot: prot,
 		Port: 0,
 	}
 
-	client, err := DialService(addr, m)
+	dial := func() (*rpc.Client, error) {
+		client, err := DialService(addr, m)
+		if err != nil {
+			return nil, err
+		}
+
+		// the port may change when the server restarts
+		client.Reconnect(func() (*rpc.Client, error) { return DialService(addr, m) }, idempotent)
+		return client, nil
+	}
+
+	client, err := dial()
+	if err != nil {
+		return nil, err
+	}
+
+	vol, err := newTarget(ctx, client, auth, fh, dirpath)
 	if err != nil {
+		client.Close()
 		return nil, err
 	}
 
+	vol.dial = dial
+
+	util.Debugf("%s:%s fsinfo=%#v", addr, dirpath, vol.fsinfo)
+	return vol, nil
+}
+
+// idempotent reports whether an NFS call can be sent again when the
+// connection is lost before its reply comes.  Repeating a WRITE rewrites the
+// same data at the same offset; if another client wrote that range in between,
+// its data is overwritten, which is the risk any client retransmitting a WRITE
+// takes, and better than failing every WRITE in flight when a server
+// restarts.  A COMMIT commits the data again.
+func idempotent(h rpc.Header) bool {
+	switch h.Proc {
+	case NFSProc3GetAttr, NFSProc3Lookup, NFSProc3Access, NFSProc3Readlink,
+		NFSProc3Read, NFSProc3Write, NFSProc3ReadDir, NFSProc3ReadDirPlus,
+		NFSProc3FSStat, NFSProc3FSInfo, NFSProc3PathConf, NFSProc3Commit:
+		return true
+	}
+
+	return false
+}
+
+// newTarget returns a Target for the export with root fh, served by client
+func newTarget(ctx context.Context, client *rpc.Client, auth rpc.Auth, fh []byte, dirpath string) (*Target, error) {
 	vol := &Target{
 		Client:  client,
 		auth:    auth,
 		fh:      fh,
 		dirPath: dirpath,
+		conns:   []*pooledConn{{Client: client}},
+		backoff: rpc.DefaultBackoff,
 	}
 
-	fsinfo, err := vol.FSInfo()
+	fsinfo, err := vol.FSInfoContext(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	vol.fsinfo = fsinfo
-	util.Debugf("%s:%s fsinfo=%#v", addr, dirpath, fsinfo)
+	if limit := uint32(client.MaxPayload()); limit != 0 {
+		clampFSInfo(fsinfo, limit)
+	}
 
+	vol.fsinfo = fsinfo
 	return vol, nil
 }
 
+// clampFSInfo limits the transfer sizes of fsinfo to limit, as the transport
+// cannot carry more
+func clampFSInfo(fsinfo *FSInfo, limit uint32) {
+	for _, size := range []*uint32{&fsinfo.RTMax, &fsinfo.RTPref, &fsinfo.WTMax, &fsinfo.WTPref, &fsinfo.DTPref} {
+		if *size == 0 || *size > limit {
+			*size = limit
+		}
+	}
+}
+
 // wraps the Call function to check status and decode errors
-func (v *Target) call(c interface{}) (io.ReadSeeker, error) {
-	res, err := v.Call(c)
+func (v *Target) call(ctx context.Context, c interface{}) (io.ReadSeeker, error) {
+	p := v.conn()
+	res, err := p.CallContext(ctx, c)
+	p.done()
 	if err != nil {
 		return nil, err
 	}
@@ -74,12 +170,17 @@ func (v *Target) call(c interface{}) (io.ReadSeeker, error) {
 }
 
 func (v *Target) FSInfo() (*FSInfo, error) {
+	return v.FSInfoContext(context.Background())
+}
+
+// FSInfoContext is FSInfo with a context
+func (v *Target) FSInfoContext(ctx context.Context) (*FSInfo, error) {
 	type FSInfoArgs struct {
 		rpc.Header
 		FsRoot []byte
 	}
 
-	res, err := v.call(&FSInfoArgs{
+	res, err := v.call(ctx, &FSInfoArgs{
 		Header: rpc.Header{
 			Rpcvers: 2,
 			Prog:    Nfs3Prog,
@@ -104,36 +205,210 @@ func (v *Target) FSInfo() (*FSInfo, error) {
 	return fsinfo, nil
 }
 
-// Lookup returns attributes and the file handle to a given dirent
-func (v *Target) Lookup(p string) (os.FileInfo, []byte, error) {
-	var (
-		err   error
+// StatFS returns the free and total space and inodes of the file system
+// holding the named path.
+func (v *Target) StatFS(p string) (*FSStat, error) {
+	return v.StatFSContext(context.Background(), p)
+}
+
+// StatFSContext is StatFS with a context
+func (v *Target) StatFSContext(ctx context.Context, p string) (*FSStat, error) {
+	type FSStat3Args struct {
+		rpc.Header
+		FH []byte
+	}
+
+	_, fh, err := v.LookupContext(ctx, p, FollowIntermediate|FollowLast)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := v.call(ctx, &FSStat3Args{
+		Header: rpc.Header{
+			Rpcvers: 2,
+			Prog:    Nfs3Prog,
+			Vers:    Nfs3Vers,
+			Proc:    NFSProc3FSStat,
+			Cred:    v.auth,
+			Verf:    rpc.AuthNull,
+		},
+		FH: fh,
+	})
+
+	if err != nil {
+		util.Debugf("fsstat(%s): %s", p, err.Error())
+		return nil, err
+	}
+
+	fsstat := new(FSStat)
+	if err = xdr.Read(res, fsstat); err != nil {
+		return nil, err
+	}
+
+	return fsstat, nil
+}
+
+// PathConf returns the name and link limits of the file system holding the
+// named path.
+func (v *Target) PathConf(p string) (*PathConf, error) {
+	return v.PathConfContext(context.Background(), p)
+}
+
+// PathConfContext is PathConf with a context
+func (v *Target) PathConfContext(ctx context.Context, p string) (*PathConf, error) {
+	type PathConf3Args struct {
+		rpc.Header
+		FH []byte
+	}
+
+	_, fh, err := v.LookupContext(ctx, p, FollowIntermediate|FollowLast)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := v.call(ctx, &PathConf3Args{
+		Header: rpc.Header{
+			Rpcvers: 2,
+			Prog:    Nfs3Prog,
+			Vers:    Nfs3Vers,
+			Proc:    NFSProc3PathConf,
+			Cred:    v.auth,
+			Verf:    rpc.AuthNull,
+		},
+		FH: fh,
+	})
+
+	if err != nil {
+		util.Debugf("pathconf(%s): %s", p, err.Error())
+		return nil, err
+	}
+
+	pathconf := new(PathConf)
+	if err = xdr.Read(res, pathconf); err != nil {
+		return nil, err
+	}
+
+	return pathconf, nil
+}
+
+// LookupOpt changes how Lookup treats symlinks found along a path
+type LookupOpt uint32
+
+const (
+	// FollowIntermediate resolves symlinks in the directory components of a
+	// path, the way a kernel client does for every path it walks.
+	FollowIntermediate LookupOpt = 1 << iota
+
+	// FollowLast resolves a symlink in the final component of a path, giving
+	// stat(2) rather than lstat(2) semantics.
+	FollowLast
+)
+
+// maximum number of symlinks resolved by a single Lookup (MAXSYMLINKS on
+// Linux) before giving up with ELOOP
+const maxSymlinks = 40
+
+// Lookup returns attributes and the file handle to a given dirent.  By
+// default symlinks are not followed; see LookupOpt.
+//
+// Absolute symlink targets are resolved against the root of the export, after
+// stripping the exported directory path if the target starts with it.
+func (v *Target) Lookup(p string, opts ...LookupOpt) (os.FileInfo, []byte, error) {
+	return v.LookupContext(context.Background(), p, opts...)
+}
+
+// LookupContext is Lookup with a context
+func (v *Target) LookupContext(ctx context.Context, p string, opts ...LookupOpt) (os.FileInfo, []byte, error) {
+	var flags LookupOpt
+	for _, opt := range opts {
+		flags |= opt
+	}
+
+	type dirent struct {
 		fattr *Fattr
-		fh    = v.fh
+		fh    []byte
+	}
+
+	var (
+		// we're assuming the root is always the root of the mount
+		walked = []dirent{{fh: v.fh}}
+		names  = splitPath(path.Clean(p))
+		links  int
 	)
 
 	// desecend down a path heirarchy to get the last elem's fh
-	dirents := strings.Split(path.Clean(p), "/")
-	for _, dirent := range dirents {
-		// we're assuming the root is always the root of the mount
-		if dirent == "." || dirent == "" {
-			util.Debugf("root -> 0x%x", fh)
+	for len(names) > 0 {
+		name := names[0]
+		names = names[1:]
+
+		if name == ".." {
+			// never walk above the root of the mount
+			if len(walked) > 1 {
+				walked = walked[:len(walked)-1]
+			}
+			continue
+		}
+
+		cwd := walked[len(walked)-1]
+		fattr, fh, err := v.lookup(ctx, cwd.fh, name)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		follow := flags&FollowIntermediate != 0
+		if len(names) == 0 {
+			follow = flags&FollowLast != 0
+		}
+
+		if fattr.Type != NF3Lnk || !follow {
+			walked = append(walked, dirent{fattr, fh})
 			continue
 		}
 
-		fattr, fh, err = v.lookup(fh, dirent)
+		if links++; links > maxSymlinks {
+			return nil, nil, &os.PathError{Op: "lookup", Path: p, Err: syscall.ELOOP}
+		}
+
+		target, err := v.readlink(ctx, fh)
 		if err != nil {
 			return nil, nil, err
 		}
 
-		//util.Debugf("%s -> 0x%x", dirent, fh)
+		util.Debugf("lookup(%s): following %s -> %s", p, name, target)
+		if path.IsAbs(target) {
+			walked = walked[:1]
+			if target == v.dirPath || strings.HasPrefix(target, v.dirPath+"/") {
+				target = strings.TrimPrefix(target, v.dirPath)
+			}
+		}
+
+		names = append(splitPath(target), names...)
+	}
+
+	last := walked[len(walked)-1]
+	if len(walked) == 1 {
+		util.Debugf("root -> 0x%x", last.fh)
+	}
+
+	return last.fattr, last.fh, nil
+}
+
+// splitPath returns the names in p, without empty and "." elements
+func splitPath(p string) []string {
+	var names []string
+	for _, name := range strings.Split(p, "/") {
+		if name == "." || name == "" {
+			continue
+		}
+
+		names = append(names, name)
 	}
 
-	return fattr, fh, nil
+	return names
 }
 
 // lookup returns the same as above, but by fh and name
-func (v *Target) lookup(fh []byte, name string) (*Fattr, []byte, error) {
+func (v *Target) lookup(ctx context.Context, fh []byte, name string) (*Fattr, []byte, error) {
 	type Lookup3Args struct {
 		rpc.Header
 		What Diropargs3
@@ -145,7 +420,7 @@ func (v *Target) lookup(fh []byte, name string) (*Fattr, []byte, error) {
 		DirAttr PostOpAttr
 	}
 
-	res, err := v.call(&Lookup3Args{
+	res, err := v.call(ctx, &Lookup3Args{
 		Header: rpc.Header{
 			Rpcvers: 2,
 			Prog:    Nfs3Prog,
@@ -176,244 +451,698 @@ func (v *Target) lookup(fh []byte, name string) (*Fattr, []byte, error) {
 	return &lookupres.Attr.Attr, lookupres.FH, nil
 }
 
-func (v *Target) ReadDirPlus(dir string) ([]*EntryPlus, error) {
-	_, fh, err := v.Lookup(dir)
-	if err != nil {
-		return nil, err
-	}
-
-	return v.readDirPlus(fh)
+// Stat returns the attributes of the named path, following symlinks.  Unlike
+// Lookup, this works for the root of the export as well.
+func (v *Target) Stat(p string) (os.FileInfo, error) {
+	return v.StatContext(context.Background(), p)
 }
 
-func (v *Target) readDirPlus(fh []byte) ([]*EntryPlus, error) {
-	cookie := uint64(0)
-	cookieVerf := uint64(0)
-	eof := false
-
-	type ReadDirPlus3Args struct {
-		rpc.Header
-		FH         []byte
-		Cookie     uint64
-		CookieVerf uint64
-		DirCount   uint32
-		MaxCount   uint32
-	}
-
-	type DirListPlus3 struct {
-		IsSet bool      `xdr:"union"`
-		Entry EntryPlus `xdr:"unioncase=1"`
-	}
-
-	type DirListOK struct {
-		DirAttrs   PostOpAttr
-		CookieVerf uint64
-	}
-
-	var entries []*EntryPlus
-	for !eof {
-		res, err := v.call(&ReadDirPlus3Args{
-			Header: rpc.Header{
-				Rpcvers: 2,
-				Prog:    Nfs3Prog,
-				Vers:    Nfs3Vers,
-				Proc:    NFSProc3ReadDirPlus,
-				Cred:    v.auth,
-				Verf:    rpc.AuthNull,
-			},
-			FH:         fh,
-			Cookie:     cookie,
-			CookieVerf: cookieVerf,
-			DirCount:   512,
-			MaxCount:   4096,
-		})
-
-		if err != nil {
-			util.Debugf("readdir(%x): %s", fh, err.Error())
-			return nil, err
-		}
-
-		// The dir list entries are so-called "optional-data".  We need to check
-		// the Follows fields before continuing down the array.  Effectively, it's
-		// an encoding used to flatten a linked list into an array where the
-		// Follows field is set when the next idx has data. See
-		// https://tools.ietf.org/html/rfc4506.html#section-4.19 for details.
-		dirlistOK := new(DirListOK)
-		if err = xdr.Read(res, dirlistOK); err != nil {
-			util.Errorf("readdir failed to parse result (%x): %s", fh, err.Error())
-			util.Debugf("partial dirlist: %+v", dirlistOK)
-			return nil, err
-		}
-
-		for {
-			var item DirListPlus3
-			if err = xdr.Read(res, &item); err != nil {
-				util.Errorf("readdir failed to parse directory entry, aborting")
-				util.Debugf("partial dirent: %+v", item)
-				return nil, err
-			}
+// StatContext is Stat with a context
+func (v *Target) StatContext(ctx context.Context, p string) (os.FileInfo, error) {
+	return v.stat(ctx, p, FollowIntermediate|FollowLast)
+}
 
-			if !item.IsSet {
-				break
-			}
+// Lstat is like Stat, but if the final component of the path is a symlink it
+// describes the link itself.
+func (v *Target) Lstat(p string) (os.FileInfo, error) {
+	return v.LstatContext(context.Background(), p)
+}
 
-			cookie = item.Entry.Cookie
-			entries = append(entries, &item.Entry)
-		}
+// LstatContext is Lstat with a context
+func (v *Target) LstatContext(ctx context.Context, p string) (os.FileInfo, error) {
+	return v.stat(ctx, p, FollowIntermediate)
+}
 
-		if err = xdr.Read(res, &eof); err != nil {
-			util.Errorf("readdir failed to determine presence of more data to read, aborting")
-			return nil, err
-		}
+func (v *Target) stat(ctx context.Context, p string, flags LookupOpt) (os.FileInfo, error) {
+	_, fh, err := v.LookupContext(ctx, p, flags)
+	if err != nil {
+		return nil, err
+	}
 
-		util.Debugf("No EOF for dirents so calling back for more")
-		cookieVerf = dirlistOK.CookieVerf
+	fattr, err := v.getattr(ctx, fh)
+	if err != nil {
+		return nil, err
 	}
 
-	return entries, nil
+	return &FileInfo{Fattr: *fattr, name: path.Base(p)}, nil
 }
 
-// Creates a directory of the given name and returns its handle
-func (v *Target) Mkdir(path string, perm os.FileMode) ([]byte, error) {
-	dir, newDir := filepath.Split(path)
-	_, fh, err := v.Lookup(dir)
+// StatFH returns the attributes of the object referenced by fh.  The handle
+// carries no name, so Name() of the result is empty.
+func (v *Target) StatFH(fh []byte) (os.FileInfo, error) {
+	return v.StatFHContext(context.Background(), fh)
+}
+
+// StatFHContext is StatFH with a context
+func (v *Target) StatFHContext(ctx context.Context, fh []byte) (os.FileInfo, error) {
+	fattr, err := v.getattr(ctx, fh)
 	if err != nil {
 		return nil, err
 	}
 
-	type MkdirArgs struct {
-		rpc.Header
-		Where Diropargs3
-		Attrs Sattr3
-	}
+	return &FileInfo{Fattr: *fattr}, nil
+}
 
-	type MkdirOk struct {
-		FH     PostOpFH3
-		Attr   PostOpAttr
-		DirWcc WccData
+// getattr fetches the attributes of the object referenced by fh
+func (v *Target) getattr(ctx context.Context, fh []byte) (*Fattr, error) {
+	type GetAttr3Args struct {
+		rpc.Header
+		FH []byte
 	}
 
-	args := &MkdirArgs{
+	res, err := v.call(ctx, &GetAttr3Args{
 		Header: rpc.Header{
 			Rpcvers: 2,
 			Prog:    Nfs3Prog,
 			Vers:    Nfs3Vers,
-			Proc:    NFSProc3Mkdir,
+			Proc:    NFSProc3GetAttr,
 			Cred:    v.auth,
 			Verf:    rpc.AuthNull,
 		},
-		Where: Diropargs3{
-			FH:       fh,
-			Filename: newDir,
-		},
-		Attrs: Sattr3{
-			Mode: SetMode{
-				SetIt: true,
-				Mode:  uint32(perm.Perm()),
-			},
-		},
-	}
-	res, err := v.call(args)
+		FH: fh,
+	})
 
 	if err != nil {
-		util.Debugf("mkdir(%s): %s", path, err.Error())
-		util.Debugf("mkdir args (%+v)", args)
+		util.Debugf("getattr(%x): %s", fh, err.Error())
 		return nil, err
 	}
 
-	mkdirres := new(MkdirOk)
-	if err := xdr.Read(res, mkdirres); err != nil {
-		util.Errorf("mkdir(%s) failed to parse return: %s", path, err)
-		util.Debugf("mkdir(%s) partial response: %+v", mkdirres)
+	fattr := new(Fattr)
+	if err = xdr.Read(res, fattr); err != nil {
+		util.Errorf("getattr(%x) failed to parse return: %s", fh, err)
 		return nil, err
 	}
 
-	util.Debugf("mkdir(%s): created successfully (0x%x)", path, fh)
-	return mkdirres.FH.FH, nil
+	util.Debugf("getattr(%x): %+v", fh, fattr)
+	return fattr, nil
 }
 
-// Create a file with name the given mode
-func (v *Target) Create(path string, perm os.FileMode) ([]byte, error) {
-	dir, newFile := filepath.Split(path)
-	_, fh, err := v.Lookup(dir)
+// SetAttr applies attrs to the named path, following symlinks as Stat does.
+// If guard is not nil, the server
+// only applies the change if the ctime of the object still matches guard, and
+// returns NFS3ERR_NOT_SYNC otherwise.
+func (v *Target) SetAttr(p string, attrs Sattr3, guard *NFS3Time) (*WccData, error) {
+	return v.SetAttrContext(context.Background(), p, attrs, guard)
+}
+
+// SetAttrContext is SetAttr with a context
+func (v *Target) SetAttrContext(ctx context.Context, p string, attrs Sattr3, guard *NFS3Time) (*WccData, error) {
+	_, fh, err := v.LookupContext(ctx, p, FollowIntermediate|FollowLast)
 	if err != nil {
 		return nil, err
 	}
 
-	type How struct {
-		// 0 : UNCHECKED (default)
-		// 1 : GUARDED
-		// 2 : EXCLUSIVE
-		Mode uint32
-		Attr Sattr3
-	}
-	type Create3Args struct {
-		rpc.Header
-		Where Diropargs3
-		HW    How
+	return v.setattr(ctx, fh, attrs, guard)
+}
+
+// Chmod changes the permission bits of the named path
+func (v *Target) Chmod(p string, mode os.FileMode) error {
+	return v.ChmodContext(context.Background(), p, mode)
+}
+
+// ChmodContext is Chmod with a context
+func (v *Target) ChmodContext(ctx context.Context, p string, mode os.FileMode) error {
+	_, err := v.SetAttrContext(ctx, p, chmodAttr(mode), nil)
+	return err
+}
+
+// Chown changes the owner and group of the named path.  A uid or gid of -1
+// leaves that value unchanged.
+func (v *Target) Chown(p string, uid, gid int) error {
+	return v.ChownContext(context.Background(), p, uid, gid)
+}
+
+// ChownContext is Chown with a context
+func (v *Target) ChownContext(ctx context.Context, p string, uid, gid int) error {
+	_, err := v.SetAttrContext(ctx, p, chownAttr(uid, gid), nil)
+	return err
+}
+
+// Chtimes changes the access and modification times of the named path
+func (v *Target) Chtimes(p string, atime time.Time, mtime time.Time) error {
+	return v.ChtimesContext(context.Background(), p, atime, mtime)
+}
+
+// ChtimesContext is Chtimes with a context
+func (v *Target) ChtimesContext(ctx context.Context, p string, atime time.Time, mtime time.Time) error {
+	_, err := v.SetAttrContext(ctx, p, chtimesAttr(atime, mtime), nil)
+	return err
+}
+
+// Truncate changes the size of the named file
+func (v *Target) Truncate(p string, size int64) error {
+	return v.TruncateContext(context.Background(), p, size)
+}
+
+// TruncateContext is Truncate with a context
+func (v *Target) TruncateContext(ctx context.Context, p string, size int64) error {
+	_, err := v.SetAttrContext(ctx, p, truncateAttr(size), nil)
+	return err
+}
+
+// setattr returns the same as SetAttr, but by fh
+func (v *Target) setattr(ctx context.Context, fh []byte, attrs Sattr3, guard *NFS3Time) (*WccData, error) {
+	type SattrGuard3 struct {
+		Check bool     `xdr:"union"`
+		Ctime NFS3Time `xdr:"unioncase=1"`
 	}
 
-	type Create3Res struct {
-		FH     PostOpFH3
-		Attr   PostOpAttr
-		DirWcc WccData
+	type SetAttr3Args struct {
+		rpc.Header
+		FH    []byte
+		Attrs Sattr3
+		Guard SattrGuard3
 	}
 
-	res, err := v.call(&Create3Args{
+	args := &SetAttr3Args{
 		Header: rpc.Header{
 			Rpcvers: 2,
 			Prog:    Nfs3Prog,
 			Vers:    Nfs3Vers,
-			Proc:    NFSProc3Create,
+			Proc:    NFSProc3SetAttr,
 			Cred:    v.auth,
 			Verf:    rpc.AuthNull,
 		},
-		Where: Diropargs3{
-			FH:       fh,
-			Filename: newFile,
-		},
-		HW: How{
-			Attr: Sattr3{
-				Mode: SetMode{
-					SetIt: true,
-					Mode:  uint32(perm.Perm()),
-				},
-			},
-		},
-	})
+		FH:    fh,
+		Attrs: attrs,
+	}
+
+	if guard != nil {
+		args.Guard.Check = true
+		args.Guard.Ctime = *guard
+	}
 
+	res, err := v.call(ctx, args)
 	if err != nil {
-		util.Debugf("create(%s): %s", path, err.Error())
+		util.Debugf("setattr(%x): %s", fh, err.Error())
 		return nil, err
 	}
 
-	status := new(Create3Res)
-	if err = xdr.Read(res, status); err != nil {
+	wcc := new(WccData)
+	if err = xdr.Read(res, wcc); err != nil {
+		util.Errorf("setattr(%x) failed to parse return: %s", fh, err)
 		return nil, err
 	}
 
-	util.Debugf("create(%s): created successfully", path)
-	return status.FH.FH, nil
+	util.Debugf("setattr(%x): %+v", fh, attrs)
+	return wcc, nil
 }
 
-// Remove a file
-func (v *Target) Remove(path string) error {
-	parentDir, deleteFile := filepath.Split(path)
-	_, fh, err := v.Lookup(parentDir)
-	if err != nil {
-		return err
+func chmodAttr(mode os.FileMode) Sattr3 {
+	return Sattr3{
+		Mode: SetMode{
+			SetIt: true,
+			Mode:  mode3(mode),
+		},
+	}
+}
+
+// mode3 returns the mode3 bits for the permissions of mode, including setuid,
+// setgid and sticky, the reverse of Fattr.Mode
+func mode3(mode os.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		m |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= 01000
 	}
 
-	return v.remove(fh, deleteFile)
+	return m
 }
 
-// remove the named file from the parent (fh)
-func (v *Target) remove(fh []byte, deleteFile string) error {
-	type RemoveArgs struct {
-		rpc.Header
-		Object Diropargs3
+func chownAttr(uid, gid int) Sattr3 {
+	var attrs Sattr3
+	if uid >= 0 {
+		attrs.UID = SetUID{SetIt: true, UID: uint32(uid)}
 	}
 
-	_, err := v.call(&RemoveArgs{
+	if gid >= 0 {
+		attrs.GID = SetUID{SetIt: true, UID: uint32(gid)}
+	}
+
+	return attrs
+}
+
+func chtimesAttr(atime time.Time, mtime time.Time) Sattr3 {
+	return Sattr3{
+		Atime: SetTime{
+			SetIt: SetToClientTime,
+			Time:  toNFS3Time(atime),
+		},
+		Mtime: SetTime{
+			SetIt: SetToClientTime,
+			Time:  toNFS3Time(mtime),
+		},
+	}
+}
+
+func truncateAttr(size int64) Sattr3 {
+	return Sattr3{
+		Size: SetSize{
+			SetIt: true,
+			Size:  uint64(size),
+		},
+	}
+}
+
+// Access asks the server which of the Access3* permissions in mask the
+// credential of the Target holds on the named path, and returns the granted
+// subset.  The server may still deny the operation itself, e.g. on a read-only
+// export, so this is advisory only.
+func (v *Target) Access(p string, mask uint32) (uint32, error) {
+	return v.AccessContext(context.Background(), p, mask)
+}
+
+// AccessContext is Access with a context
+func (v *Target) AccessContext(ctx context.Context, p string, mask uint32) (uint32, error) {
+	_, fh, err := v.LookupContext(ctx, p, FollowIntermediate|FollowLast)
+	if err != nil {
+		return 0, err
+	}
+
+	granted, _, err := v.access(ctx, fh, mask)
+	return granted, err
+}
+
+// CanRead reports whether the file at path can be read, or the directory at
+// path listed.
+func (v *Target) CanRead(p string) (bool, error) {
+	return v.CanReadContext(context.Background(), p)
+}
+
+// CanReadContext is CanRead with a context
+func (v *Target) CanReadContext(ctx context.Context, p string) (bool, error) {
+	granted, err := v.AccessContext(ctx, p, Access3Read)
+	return granted&Access3Read != 0, err
+}
+
+// CanWrite reports whether the file at path can be modified, or entries can be
+// added to the directory at path.
+func (v *Target) CanWrite(p string) (bool, error) {
+	return v.CanWriteContext(context.Background(), p)
+}
+
+// CanWriteContext is CanWrite with a context
+func (v *Target) CanWriteContext(ctx context.Context, p string) (bool, error) {
+	granted, err := v.AccessContext(ctx, p, Access3Modify|Access3Extend)
+	return granted&(Access3Modify|Access3Extend) != 0, err
+}
+
+// CanExecute reports whether the file at path can be executed, or the
+// directory at path searched.
+func (v *Target) CanExecute(p string) (bool, error) {
+	return v.CanExecuteContext(context.Background(), p)
+}
+
+// CanExecuteContext is CanExecute with a context
+func (v *Target) CanExecuteContext(ctx context.Context, p string) (bool, error) {
+	_, fh, err := v.LookupContext(ctx, p, FollowIntermediate|FollowLast)
+	if err != nil {
+		return false, err
+	}
+
+	granted, fattr, err := v.access(ctx, fh, Access3Execute|Access3Lookup)
+	if err != nil {
+		return false, err
+	}
+
+	if fattr != nil && fattr.IsDir() {
+		return granted&Access3Lookup != 0, nil
+	}
+
+	return granted&Access3Execute != 0, nil
+}
+
+// CanDelete reports whether the named path can be removed from its parent
+// directory.
+func (v *Target) CanDelete(p string) (bool, error) {
+	return v.CanDeleteContext(context.Background(), p)
+}
+
+// CanDeleteContext is CanDelete with a context
+func (v *Target) CanDeleteContext(ctx context.Context, p string) (bool, error) {
+	dir, _ := filepath.Split(p)
+	granted, err := v.AccessContext(ctx, dir, Access3Delete)
+	return granted&Access3Delete != 0, err
+}
+
+// access returns the granted permissions in mask on fh, and the attributes of
+// the object if the server returned them.
+func (v *Target) access(ctx context.Context, fh []byte, mask uint32) (uint32, *Fattr, error) {
+	type Access3Args struct {
+		rpc.Header
+		FH     []byte
+		Access uint32
+	}
+
+	type Access3Res struct {
+		Attr   PostOpAttr
+		Access uint32
+	}
+
+	res, err := v.call(ctx, &Access3Args{
+		Header: rpc.Header{
+			Rpcvers: 2,
+			Prog:    Nfs3Prog,
+			Vers:    Nfs3Vers,
+			Proc:    NFSProc3Access,
+			Cred:    v.auth,
+			Verf:    rpc.AuthNull,
+		},
+		FH:     fh,
+		Access: mask,
+	})
+
+	if err != nil {
+		util.Debugf("access(%x): %s", fh, err.Error())
+		return 0, nil, err
+	}
+
+	accessres := new(Access3Res)
+	if err = xdr.Read(res, accessres); err != nil {
+		util.Errorf("access(%x) failed to parse return: %s", fh, err)
+		return 0, nil, err
+	}
+
+	util.Debugf("access(%x): requested 0x%x, granted 0x%x", fh, mask, accessres.Access)
+	if !accessres.Attr.IsSet {
+		return accessres.Access, nil, nil
+	}
+
+	return accessres.Access, &accessres.Attr.Attr, nil
+}
+
+// Creates a directory of the given name and returns its handle
+func (v *Target) Mkdir(path string, perm os.FileMode) ([]byte, error) {
+	return v.MkdirContext(context.Background(), path, perm)
+}
+
+// MkdirContext is Mkdir with a context
+func (v *Target) MkdirContext(ctx context.Context, path string, perm os.FileMode) ([]byte, error) {
+	dir, newDir := filepath.Split(path)
+	_, fh, err := v.LookupContext(ctx, dir, FollowIntermediate|FollowLast)
+	if err != nil {
+		return nil, err
+	}
+
+	type MkdirArgs struct {
+		rpc.Header
+		Where Diropargs3
+		Attrs Sattr3
+	}
+
+	type MkdirOk struct {
+		FH     PostOpFH3
+		Attr   PostOpAttr
+		DirWcc WccData
+	}
+
+	args := &MkdirArgs{
+		Header: rpc.Header{
+			Rpcvers: 2,
+			Prog:    Nfs3Prog,
+			Vers:    Nfs3Vers,
+			Proc:    NFSProc3Mkdir,
+			Cred:    v.auth,
+			Verf:    rpc.AuthNull,
+		},
+		Where: Diropargs3{
+			FH:       fh,
+			Filename: newDir,
+		},
+		Attrs: chmodAttr(perm),
+	}
+	res, err := v.call(ctx, args)
+
+	if err != nil {
+		util.Debugf("mkdir(%s): %s", path, err.Error())
+		util.Debugf("mkdir args (%+v)", args)
+		return nil, err
+	}
+
+	mkdirres := new(MkdirOk)
+	if err := xdr.Read(res, mkdirres); err != nil {
+		util.Errorf("mkdir(%s) failed to parse return: %s", path, err)
+		util.Debugf("mkdir(%s) partial response: %+v", mkdirres)
+		return nil, err
+	}
+
+	util.Debugf("mkdir(%s): created successfully (0x%x)", path, fh)
+	return mkdirres.FH.FH, nil
+}
+
+// create modes of CREATE
+const (
+	createUnchecked = iota
+	createGuarded
+	createExclusive
+)
+
+// Create a file with name the given mode
+func (v *Target) Create(path string, perm os.FileMode) ([]byte, error) {
+	return v.CreateContext(context.Background(), path, perm)
+}
+
+// CreateContext is Create with a context
+func (v *Target) CreateContext(ctx context.Context, path string, perm os.FileMode) ([]byte, error) {
+	return v.create(ctx, path, createUnchecked, perm)
+}
+
+// CreateExclusive creates a file that must not exist yet, using an EXCLUSIVE
+// CREATE.  Unlike a GUARDED create (as done by OpenFile with O_EXCL), this is
+// safe against retransmissions: a retried request that the server already
+// carried out succeeds rather than failing with os.ErrExist.  That makes it
+// suitable for lock files.  The mode is set with a SETATTR afterwards, since
+// the server uses the attributes of the file to store the create verifier.
+func (v *Target) CreateExclusive(path string, perm os.FileMode) ([]byte, error) {
+	return v.CreateExclusiveContext(context.Background(), path, perm)
+}
+
+// CreateExclusiveContext is CreateExclusive with a context
+func (v *Target) CreateExclusiveContext(ctx context.Context, path string, perm os.FileMode) ([]byte, error) {
+	fh, err := v.create(ctx, path, createExclusive, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := chmodAttr(perm)
+	attrs.Atime.SetIt = SetToServerTime
+	attrs.Mtime.SetIt = SetToServerTime
+	if _, err = v.setattr(ctx, fh, attrs, nil); err != nil {
+		return nil, err
+	}
+
+	return fh, nil
+}
+
+func (v *Target) create(ctx context.Context, path string, mode uint32, perm os.FileMode) ([]byte, error) {
+	dir, newFile := filepath.Split(path)
+	_, fh, err := v.LookupContext(ctx, dir, FollowIntermediate|FollowLast)
+	if err != nil {
+		return nil, err
+	}
+
+	// createhow3 carries initial attributes for UNCHECKED and GUARDED, and a
+	// verifier for EXCLUSIVE
+	type How struct {
+		// 0 : UNCHECKED (default)
+		// 1 : GUARDED
+		// 2 : EXCLUSIVE
+		Mode uint32
+		Attr Sattr3
+	}
+
+	type HowExclusive struct {
+		Mode uint32
+		Verf uint64
+	}
+
+	type Create3Args struct {
+		rpc.Header
+		Where Diropargs3
+		HW    interface{}
+	}
+
+	type Create3Res struct {
+		FH     PostOpFH3
+		Attr   PostOpAttr
+		DirWcc WccData
+	}
+
+	var how interface{} = &How{
+		Mode: mode,
+		Attr: chmodAttr(perm),
+	}
+
+	if mode == createExclusive {
+		// the verifier tells a retransmission from another client creating
+		// the same file, so it must not be guessable or repeat across clients
+		var verf [8]byte
+		if _, err = rand.Read(verf[:]); err != nil {
+			return nil, err
+		}
+
+		how = &HowExclusive{
+			Mode: mode,
+			Verf: binary.BigEndian.Uint64(verf[:]),
+		}
+	}
+
+	res, err := v.call(ctx, &Create3Args{
+		Header: rpc.Header{
+			Rpcvers: 2,
+			Prog:    Nfs3Prog,
+			Vers:    Nfs3Vers,
+			Proc:    NFSProc3Create,
+			Cred:    v.auth,
+			Verf:    rpc.AuthNull,
+		},
+		Where: Diropargs3{
+			FH:       fh,
+			Filename: newFile,
+		},
+		HW: how,
+	})
+
+	if err != nil {
+		util.Debugf("create(%s): %s", path, err.Error())
+		return nil, err
+	}
+
+	status := new(Create3Res)
+	if err = xdr.Read(res, status); err != nil {
+		return nil, err
+	}
+
+	util.Debugf("create(%s): created successfully", path)
+	if status.FH.IsSet {
+		return status.FH.FH, nil
+	}
+
+	// the handle is optional in the reply
+	_, newfh, err := v.lookup(ctx, fh, newFile)
+	return newfh, err
+}
+
+// Mknod creates a special file and returns its handle.  The type bits of mode
+// select a block or character device (os.ModeDevice, plus os.ModeCharDevice),
+// a FIFO (os.ModeNamedPipe) or a socket (os.ModeSocket).  dev is only used for
+// devices, and is split into major and minor numbers with Major and Minor.
+func (v *Target) Mknod(path string, mode os.FileMode, dev uint64) ([]byte, error) {
+	return v.MknodContext(context.Background(), path, mode, dev)
+}
+
+// MknodContext is Mknod with a context
+func (v *Target) MknodContext(ctx context.Context, path string, mode os.FileMode, dev uint64) ([]byte, error) {
+	var ftype uint32
+	switch {
+	case mode&os.ModeCharDevice != 0:
+		ftype = NF3Chr
+	case mode&os.ModeDevice != 0:
+		ftype = NF3Blk
+	case mode&os.ModeNamedPipe != 0:
+		ftype = NF3FIFO
+	case mode&os.ModeSocket != 0:
+		ftype = NF3Sock
+	default:
+		return nil, &os.PathError{Op: "mknod", Path: path, Err: os.ErrInvalid}
+	}
+
+	dir, newFile := filepath.Split(path)
+	_, fh, err := v.LookupContext(ctx, dir, FollowIntermediate|FollowLast)
+	if err != nil {
+		return nil, err
+	}
+
+	// mknoddata3 is a union on the file type: devices carry their attributes
+	// and a specdata3, sockets and FIFOs only their attributes.
+	type Mknod3Args struct {
+		rpc.Header
+		Where Diropargs3
+		Type  uint32
+		Attrs Sattr3
+	}
+
+	type MknodDev3Args struct {
+		Mknod3Args
+		Spec [2]uint32
+	}
+
+	type Mknod3Res struct {
+		FH     PostOpFH3
+		Attr   PostOpAttr
+		DirWcc WccData
+	}
+
+	args := Mknod3Args{
+		Header: rpc.Header{
+			Rpcvers: 2,
+			Prog:    Nfs3Prog,
+			Vers:    Nfs3Vers,
+			Proc:    NFSProc3Mknod,
+			Cred:    v.auth,
+			Verf:    rpc.AuthNull,
+		},
+		Where: Diropargs3{
+			FH:       fh,
+			Filename: newFile,
+		},
+		Type:  ftype,
+		Attrs: chmodAttr(mode),
+	}
+
+	var call interface{} = &args
+	if ftype == NF3Chr || ftype == NF3Blk {
+		call = &MknodDev3Args{
+			Mknod3Args: args,
+			Spec:       [2]uint32{Major(dev), Minor(dev)},
+		}
+	}
+
+	res, err := v.call(ctx, call)
+	if err != nil {
+		util.Debugf("mknod(%s): %s", path, err.Error())
+		return nil, err
+	}
+
+	mknodres := new(Mknod3Res)
+	if err = xdr.Read(res, mknodres); err != nil {
+		util.Errorf("mknod(%s) failed to parse return: %s", path, err)
+		return nil, err
+	}
+
+	util.Debugf("mknod(%s): created successfully", path)
+	return mknodres.FH.FH, nil
+}
+
+// Remove a file
+func (v *Target) Remove(path string) error {
+	return v.RemoveContext(context.Background(), path)
+}
+
+// RemoveContext is Remove with a context
+func (v *Target) RemoveContext(ctx context.Context, path string) error {
+	parentDir, deleteFile := filepath.Split(path)
+	_, fh, err := v.LookupContext(ctx, parentDir, FollowIntermediate|FollowLast)
+	if err != nil {
+		return err
+	}
+
+	return v.remove(ctx, fh, deleteFile)
+}
+
+// remove the named file from the parent (fh)
+func (v *Target) remove(ctx context.Context, fh []byte, deleteFile string) error {
+	type RemoveArgs struct {
+		rpc.Header
+		Object Diropargs3
+	}
+
+	_, err := v.call(ctx, &RemoveArgs{
 		Header: rpc.Header{
 			Rpcvers: 2,
 			Prog:    Nfs3Prog,
@@ -438,23 +1167,28 @@ func (v *Target) remove(fh []byte, deleteFile string) error {
 
 // RmDir removes a non-empty directory
 func (v *Target) RmDir(path string) error {
+	return v.RmDirContext(context.Background(), path)
+}
+
+// RmDirContext is RmDir with a context
+func (v *Target) RmDirContext(ctx context.Context, path string) error {
 	dir, deletedir := filepath.Split(path)
-	_, fh, err := v.Lookup(dir)
+	_, fh, err := v.LookupContext(ctx, dir, FollowIntermediate|FollowLast)
 	if err != nil {
 		return err
 	}
 
-	return v.rmDir(fh, deletedir)
+	return v.rmDir(ctx, fh, deletedir)
 }
 
 // delete the named directory from the parent directory (fh)
-func (v *Target) rmDir(fh []byte, name string) error {
+func (v *Target) rmDir(ctx context.Context, fh []byte, name string) error {
 	type RmDir3Args struct {
 		rpc.Header
 		Object Diropargs3
 	}
 
-	_, err := v.call(&RmDir3Args{
+	_, err := v.call(ctx, &RmDir3Args{
 		Header: rpc.Header{
 			Rpcvers: 2,
 			Prog:    Nfs3Prog,
@@ -478,16 +1212,275 @@ func (v *Target) rmDir(fh []byte, name string) error {
 	return nil
 }
 
+// Rename moves oldpath to newpath, replacing newpath if it exists and the
+// server allows it.  Moving across file systems fails with NFS3ERR_XDEV (see
+// IsXDevError), replacing a non-empty directory with NFS3ERR_NOTEMPTY (see
+// IsNotEmptyError), and replacing an object of an incompatible type with
+// os.ErrExist.
+func (v *Target) Rename(oldpath, newpath string) error {
+	return v.RenameContext(context.Background(), oldpath, newpath)
+}
+
+// RenameContext is Rename with a context
+func (v *Target) RenameContext(ctx context.Context, oldpath, newpath string) error {
+	fromDir, fromName := filepath.Split(oldpath)
+	_, fromfh, err := v.LookupContext(ctx, fromDir, FollowIntermediate|FollowLast)
+	if err != nil {
+		return err
+	}
+
+	toDir, toName := filepath.Split(newpath)
+	_, tofh, err := v.LookupContext(ctx, toDir, FollowIntermediate|FollowLast)
+	if err != nil {
+		return err
+	}
+
+	_, _, err = v.RenameFHContext(ctx, fromfh, fromName, tofh, toName)
+	return err
+}
+
+// RenameFH moves fromName in the directory fromfh to toName in the directory
+// tofh, and returns the weak cache consistency data of both directories.
+func (v *Target) RenameFH(fromfh []byte, fromName string, tofh []byte, toName string) (*WccData, *WccData, error) {
+	return v.RenameFHContext(context.Background(), fromfh, fromName, tofh, toName)
+}
+
+// RenameFHContext is RenameFH with a context
+func (v *Target) RenameFHContext(ctx context.Context, fromfh []byte, fromName string, tofh []byte, toName string) (*WccData, *WccData, error) {
+	type Rename3Args struct {
+		rpc.Header
+		From Diropargs3
+		To   Diropargs3
+	}
+
+	type Rename3Res struct {
+		FromDirWcc WccData
+		ToDirWcc   WccData
+	}
+
+	res, err := v.call(ctx, &Rename3Args{
+		Header: rpc.Header{
+			Rpcvers: 2,
+			Prog:    Nfs3Prog,
+			Vers:    Nfs3Vers,
+			Proc:    NFSProc3Rename,
+			Cred:    v.auth,
+			Verf:    rpc.AuthNull,
+		},
+		From: Diropargs3{
+			FH:       fromfh,
+			Filename: fromName,
+		},
+		To: Diropargs3{
+			FH:       tofh,
+			Filename: toName,
+		},
+	})
+
+	if err != nil {
+		util.Debugf("rename(%s -> %s): %s", fromName, toName, err.Error())
+		return nil, nil, err
+	}
+
+	renameres := new(Rename3Res)
+	if err = xdr.Read(res, renameres); err != nil {
+		util.Errorf("rename(%s -> %s) failed to parse return: %s", fromName, toName, err)
+		return nil, nil, err
+	}
+
+	util.Debugf("rename(%s -> %s): renamed successfully", fromName, toName)
+	return &renameres.FromDirWcc, &renameres.ToDirWcc, nil
+}
+
+// Symlink creates linkpath as a symbolic link to target
+func (v *Target) Symlink(target, linkpath string) error {
+	return v.SymlinkContext(context.Background(), target, linkpath)
+}
+
+// SymlinkContext is Symlink with a context
+func (v *Target) SymlinkContext(ctx context.Context, target, linkpath string) error {
+	dir, name := filepath.Split(linkpath)
+	_, fh, err := v.LookupContext(ctx, dir, FollowIntermediate|FollowLast)
+	if err != nil {
+		return err
+	}
+
+	type Symlink3Args struct {
+		rpc.Header
+		Where Diropargs3
+		Attrs Sattr3
+		Data  string
+	}
+
+	type Symlink3Res struct {
+		FH     PostOpFH3
+		Attr   PostOpAttr
+		DirWcc WccData
+	}
+
+	res, err := v.call(ctx, &Symlink3Args{
+		Header: rpc.Header{
+			Rpcvers: 2,
+			Prog:    Nfs3Prog,
+			Vers:    Nfs3Vers,
+			Proc:    NFSProc3Symlink,
+			Cred:    v.auth,
+			Verf:    rpc.AuthNull,
+		},
+		Where: Diropargs3{
+			FH:       fh,
+			Filename: name,
+		},
+		Data: target,
+	})
+
+	if err != nil {
+		util.Debugf("symlink(%s -> %s): %s", linkpath, target, err.Error())
+		return err
+	}
+
+	symlinkres := new(Symlink3Res)
+	if err = xdr.Read(res, symlinkres); err != nil {
+		util.Errorf("symlink(%s) failed to parse return: %s", linkpath, err)
+		return err
+	}
+
+	util.Debugf("symlink(%s -> %s): created successfully", linkpath, target)
+	return nil
+}
+
+// Link creates newpath as a hard link to oldpath.  A symlink at oldpath is
+// linked itself rather than followed.
+func (v *Target) Link(oldpath, newpath string) error {
+	return v.LinkContext(context.Background(), oldpath, newpath)
+}
+
+// LinkContext is Link with a context
+func (v *Target) LinkContext(ctx context.Context, oldpath, newpath string) error {
+	_, fh, err := v.LookupContext(ctx, oldpath, FollowIntermediate)
+	if err != nil {
+		return err
+	}
+
+	dir, name := filepath.Split(newpath)
+	_, dirfh, err := v.LookupContext(ctx, dir, FollowIntermediate|FollowLast)
+	if err != nil {
+		return err
+	}
+
+	type Link3Args struct {
+		rpc.Header
+		FH   []byte
+		Link Diropargs3
+	}
+
+	type Link3Res struct {
+		Attr       PostOpAttr
+		LinkDirWcc WccData
+	}
+
+	res, err := v.call(ctx, &Link3Args{
+		Header: rpc.Header{
+			Rpcvers: 2,
+			Prog:    Nfs3Prog,
+			Vers:    Nfs3Vers,
+			Proc:    NFSProc3Link,
+			Cred:    v.auth,
+			Verf:    rpc.AuthNull,
+		},
+		FH: fh,
+		Link: Diropargs3{
+			FH:       dirfh,
+			Filename: name,
+		},
+	})
+
+	if err != nil {
+		util.Debugf("link(%s -> %s): %s", newpath, oldpath, err.Error())
+		return err
+	}
+
+	linkres := new(Link3Res)
+	if err = xdr.Read(res, linkres); err != nil {
+		util.Errorf("link(%s) failed to parse return: %s", newpath, err)
+		return err
+	}
+
+	util.Debugf("link(%s -> %s): created successfully", newpath, oldpath)
+	return nil
+}
+
+// Readlink returns the target of the named symlink
+func (v *Target) Readlink(p string) (string, error) {
+	return v.ReadlinkContext(context.Background(), p)
+}
+
+// ReadlinkContext is Readlink with a context
+func (v *Target) ReadlinkContext(ctx context.Context, p string) (string, error) {
+	_, fh, err := v.LookupContext(ctx, p, FollowIntermediate)
+	if err != nil {
+		return "", err
+	}
+
+	return v.readlink(ctx, fh)
+}
+
+// readlink returns the same as above, but by fh
+func (v *Target) readlink(ctx context.Context, fh []byte) (string, error) {
+	type ReadlinkArgs struct {
+		rpc.Header
+		FH []byte
+	}
+
+	type ReadlinkRes struct {
+		Attr PostOpAttr
+		data []byte
+	}
+
+	r, err := v.call(ctx, &ReadlinkArgs{
+		Header: rpc.Header{
+			Rpcvers: 2,
+			Prog:    Nfs3Prog,
+			Vers:    Nfs3Vers,
+			Proc:    NFSProc3Readlink,
+			Cred:    v.auth,
+			Verf:    rpc.AuthNull,
+		},
+		FH: fh,
+	})
+
+	if err != nil {
+		util.Debugf("readlink(%x): %s", fh, err.Error())
+		return "", err
+	}
+
+	readlinkres := &ReadlinkRes{}
+	if err = xdr.Read(r, readlinkres); err != nil {
+		return "", err
+	}
+
+	if readlinkres.data, err = xdr.ReadOpaque(r); err != nil {
+		return "", err
+	}
+
+	return string(readlinkres.data), err
+}
+
 func (v *Target) RemoveAll(path string) error {
+	return v.RemoveAllContext(context.Background(), path)
+}
+
+// RemoveAllContext is RemoveAll with a context
+func (v *Target) RemoveAllContext(ctx context.Context, path string) error {
 	parentDir, deleteDir := filepath.Split(path)
-	_, parentDirfh, err := v.Lookup(parentDir)
+	_, parentDirfh, err := v.LookupContext(ctx, parentDir, FollowIntermediate|FollowLast)
 	if err != nil {
 		return err
 	}
 
 	// Easy path.  This is a directory and it's empty.  If not a dir or not an
 	// empty dir, this will throw an error.
-	err = v.rmDir(parentDirfh, deleteDir)
+	err = v.rmDir(ctx, parentDirfh, deleteDir)
 	if err == nil || os.IsNotExist(err) {
 		return nil
 	}
@@ -497,17 +1490,17 @@ func (v *Target) RemoveAll(path string) error {
 		return err
 	}
 
-	_, deleteDirfh, err := v.lookup(parentDirfh, deleteDir)
+	_, deleteDirfh, err := v.lookup(ctx, parentDirfh, deleteDir)
 	if err != nil {
 		return err
 	}
 
-	if err = v.removeAll(deleteDirfh); err != nil {
+	if err = v.removeAll(ctx, deleteDirfh); err != nil {
 		return err
 	}
 
 	// Delete the directory we started at.
-	if err = v.rmDir(parentDirfh, deleteDir); err != nil {
+	if err = v.rmDir(ctx, parentDirfh, deleteDir); err != nil {
 		return err
 	}
 
@@ -515,13 +1508,13 @@ func (v *Target) RemoveAll(path string) error {
 }
 
 // removeAll removes the deleteDir recursively
-func (v *Target) removeAll(deleteDirfh []byte) error {
+func (v *Target) removeAll(ctx context.Context, deleteDirfh []byte) error {
 
 	// BFS the dir tree recursively.  If dir, recurse, then delete the dir and
 	// all files.
 
 	// This is a directory, get all of its Entries
-	entries, err := v.readDirPlus(deleteDirfh)
+	entries, err := v.readDirPlus(ctx, deleteDirfh)
 	if err != nil {
 		return err
 	}
@@ -536,16 +1529,16 @@ func (v *Target) removeAll(deleteDirfh []byte) error {
 		// back.
 		if entry.Attr.Attr.Type == NF3Dir {
 			if entry.Handle.IsSet {
-				if err = v.removeAll(entry.Handle.FH); err != nil {
+				if err = v.removeAll(ctx, entry.Handle.FH); err != nil {
 					return err
 				}
 			}
 
-			err = v.rmDir(deleteDirfh, entry.FileName)
+			err = v.rmDir(ctx, deleteDirfh, entry.FileName)
 		} else {
 
 			// nuke all files
-			err = v.remove(deleteDirfh, entry.FileName)
+			err = v.remove(ctx, deleteDirfh, entry.FileName)
 		}
 
 		if err != nil {
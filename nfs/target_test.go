@@ -0,0 +1,493 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+package nfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/zesagata/go-nfs-client/nfs/rpc"
+)
+
+func TestChmod(t *testing.T) {
+	s := newFakeServer(t)
+	s.file("f", "")
+
+	v := s.target()
+	mode := 0750 | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+	if err := v.Chmod("f", mode); err != nil {
+		t.Fatalf("chmod: %s", err)
+	}
+
+	fi, err := v.Stat("f")
+	if err != nil || fi.Mode() != mode {
+		t.Fatalf("stat after chmod: expected %s, got %v, %v", mode, fi.Mode(), err)
+	}
+
+	// the mode reported by Stat can be set back as is
+	if err = v.Chmod("f", fi.Mode()&^os.ModeSticky); err != nil {
+		t.Fatalf("chmod: %s", err)
+	}
+
+	if fi, _ = v.Stat("f"); fi.Mode() != mode&^os.ModeSticky {
+		t.Fatalf("stat after chmod: expected %s, got %s", mode&^os.ModeSticky, fi.Mode())
+	}
+
+	if err = v.Chmod("missing", 0644); !os.IsNotExist(err) {
+		t.Fatalf("chmod of a missing file: expected not exist, got %v", err)
+	}
+}
+
+func TestSetAttr(t *testing.T) {
+	s := newFakeServer(t)
+	s.file("f", "hello")
+
+	v := s.target()
+	fi, err := v.Stat("f")
+	if err != nil {
+		t.Fatalf("stat: %s", err)
+	}
+
+	// the guard matches the ctime the change is based on
+	ctime := fi.Sys().(*Fattr).Ctime
+	wcc, err := v.SetAttr("f", chmodAttr(0600), &ctime)
+	if err != nil || !wcc.After.IsSet || wcc.After.Attr.Mode() != 0600 {
+		t.Fatalf("guarded setattr: %+v, %v", wcc, err)
+	}
+
+	// the change above moved the ctime on
+	if _, err = v.SetAttr("f", chmodAttr(0644), &ctime); !IsNotSyncError(err) {
+		t.Fatalf("setattr with a stale guard: expected NOT_SYNC, got %v", err)
+	}
+
+	if fi, _ = v.Stat("f"); fi.Mode() != 0600 {
+		t.Fatalf("setattr with a stale guard changed the mode to %s", fi.Mode())
+	}
+
+	if err = v.Chown("f", 1000, 2000); err != nil {
+		t.Fatalf("chown: %s", err)
+	}
+
+	if err = v.Chown("f", -1, 3000); err != nil {
+		t.Fatalf("chown: %s", err)
+	}
+
+	fi, _ = v.Stat("f")
+	if fattr := fi.Sys().(*Fattr); fattr.UID != 1000 || fattr.GID != 3000 {
+		t.Fatalf("stat after chown: expected 1000:3000, got %d:%d", fattr.UID, fattr.GID)
+	}
+
+	atime, mtime := time.Unix(1600000000, 500), time.Unix(1700000000, 0)
+	if err = v.Chtimes("f", atime, mtime); err != nil {
+		t.Fatalf("chtimes: %s", err)
+	}
+
+	fi, _ = v.Stat("f")
+	if fattr := fi.Sys().(*Fattr); !fi.ModTime().Equal(mtime) || fattr.Atime != (NFS3Time{Seconds: 1600000000, Nseconds: 500}) {
+		t.Fatalf("stat after chtimes: mtime %s, atime %+v", fi.ModTime(), fattr.Atime)
+	}
+
+	for _, size := range []int64{2, 4} {
+		if err = v.Truncate("f", size); err != nil {
+			t.Fatalf("truncate: %s", err)
+		}
+
+		if fi, err = v.Stat("f"); err != nil || fi.Size() != size {
+			t.Fatalf("stat after truncate to %d: %v, %v", size, fi, err)
+		}
+	}
+
+	if data, err := readAll(t, v, "f"); err != nil || data != "he\x00\x00" {
+		t.Fatalf("contents after truncate: %q, %v", data, err)
+	}
+
+	if err = v.Chown("missing", 0, 0); !os.IsNotExist(err) {
+		t.Fatalf("chown of a missing file: expected not exist, got %v", err)
+	}
+}
+
+func TestRename(t *testing.T) {
+	s := newFakeServer(t)
+	s.file("a/f", "f")
+	s.file("a/g", "g")
+	s.file("b/full/x", "")
+	s.mkdir("b/empty")
+
+	v := s.target()
+	if err := v.Rename("a/f", "b/f"); err != nil {
+		t.Fatalf("rename: %s", err)
+	}
+
+	if _, err := v.Stat("a/f"); !os.IsNotExist(err) {
+		t.Fatalf("old name after rename: expected not exist, got %v", err)
+	}
+
+	if fi, err := v.Stat("b/f"); err != nil || fi.Size() != 1 {
+		t.Fatalf("new name after rename: %v, %v", fi, err)
+	}
+
+	// replacing an existing file
+	if err := v.Rename("a/g", "b/f"); err != nil {
+		t.Fatalf("rename over a file: %s", err)
+	}
+
+	_, afh, _ := v.Lookup("a")
+	_, bfh, _ := v.Lookup("b")
+	from, to, err := v.RenameFH(bfh, "f", afh, "h")
+	if err != nil || !from.After.IsSet || !to.After.IsSet {
+		t.Fatalf("rename by handle: %+v, %+v, %v", from, to, err)
+	}
+
+	if _, err = v.Stat("a/h"); err != nil {
+		t.Fatalf("stat after rename by handle: %s", err)
+	}
+
+	if err = v.Rename("a/missing", "b/x"); !os.IsNotExist(err) {
+		t.Fatalf("rename of a missing file: expected not exist, got %v", err)
+	}
+
+	if err = v.Rename("b/empty", "b/full"); !IsNotEmptyError(err) {
+		t.Fatalf("rename over a non-empty directory: expected NOTEMPTY, got %v", err)
+	}
+
+	if err = v.Rename("a/h", "b/empty"); err != os.ErrExist {
+		t.Fatalf("rename of a file over a directory: expected os.ErrExist, got %v", err)
+	}
+}
+
+func TestSymlinkAndLink(t *testing.T) {
+	s := newFakeServer(t)
+	s.file("d/f", "data")
+
+	v := s.target()
+	if err := v.Symlink("d/f", "flink"); err != nil {
+		t.Fatalf("symlink: %s", err)
+	}
+
+	if err := v.Symlink("d", "dlink"); err != nil {
+		t.Fatalf("symlink: %s", err)
+	}
+
+	if err := v.Symlink("elsewhere", "flink"); err != os.ErrExist {
+		t.Fatalf("symlink over an existing name: expected os.ErrExist, got %v", err)
+	}
+
+	if target, err := v.Readlink("flink"); err != nil || target != "d/f" {
+		t.Fatalf("readlink: %q, %v", target, err)
+	}
+
+	if _, err := v.Readlink("d/f"); err == nil {
+		t.Fatalf("expected an error for readlink of a regular file")
+	}
+
+	fi, err := v.Lstat("flink")
+	if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("lstat of a symlink: %v, %v", fi, err)
+	}
+
+	if err = v.Link("flink", "d/hard"); err != nil {
+		t.Fatalf("link: %s", err)
+	}
+
+	// the symlink itself was linked, not its target
+	if fi, err = v.Lstat("d/hard"); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("lstat of a link to a symlink: %v, %v", fi, err)
+	}
+
+	if err = v.Link("d/f", "d/f2"); err != nil {
+		t.Fatalf("link: %s", err)
+	}
+
+	if fi, err = v.Stat("d/f2"); err != nil || fi.Sys().(*Fattr).Nlink != 2 || fi.Size() != 4 {
+		t.Fatalf("stat of a hard link: %v, %v", fi, err)
+	}
+
+	if err = v.Link("d/missing", "d/f3"); !os.IsNotExist(err) {
+		t.Fatalf("link to a missing file: expected not exist, got %v", err)
+	}
+}
+
+func TestLookupFollow(t *testing.T) {
+	s := newFakeServer(t)
+	s.file("d/f", "data")
+	s.symlink("dlink", "d")
+	s.symlink("flink", "dlink/f")
+	s.symlink("abs", "/export/d/f")
+	s.symlink("loop", "loop")
+
+	v := s.target()
+
+	// without FollowIntermediate, a symlink is not a directory to walk
+	if _, _, err := v.Lookup("dlink/f"); err == nil {
+		t.Fatalf("expected an error walking through a symlink")
+	}
+
+	fi, _, err := v.Lookup("dlink/f", FollowIntermediate)
+	if err != nil || fi.Size() != 4 {
+		t.Fatalf("lookup through a symlink: %v, %v", fi, err)
+	}
+
+	// the last component is only followed with FollowLast
+	if fi, _, err = v.Lookup("flink", FollowIntermediate); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("lookup of a symlink: %v, %v", fi, err)
+	}
+
+	if fi, _, err = v.Lookup("flink", FollowIntermediate|FollowLast); err != nil || !fi.Mode().IsRegular() {
+		t.Fatalf("lookup following symlinks: %v, %v", fi, err)
+	}
+
+	// flink points through dlink, which FollowLast alone does not follow
+	if _, _, err = v.Lookup("flink", FollowLast); err == nil {
+		t.Fatalf("expected an error following a symlink through another one")
+	}
+
+	if fi, _, err = v.Lookup("abs", FollowLast); err != nil || fi.Size() != 4 {
+		t.Fatalf("lookup of an absolute symlink: %v, %v", fi, err)
+	}
+
+	_, _, err = v.Lookup("loop", FollowLast)
+	if perr, ok := err.(*os.PathError); !ok || perr.Err != syscall.ELOOP {
+		t.Fatalf("lookup of a symlink loop: expected ELOOP, got %v", err)
+	}
+
+	// a chain of exactly maxSymlinks links resolves, one more does not
+	s.file("end", "")
+	prev := "end"
+	for i := 0; i <= maxSymlinks; i++ {
+		name := "chain" + strconv.Itoa(i)
+		s.symlink(name, prev)
+		prev = name
+	}
+
+	if _, _, err = v.Lookup("chain"+strconv.Itoa(maxSymlinks-1), FollowLast); err != nil {
+		t.Fatalf("lookup of %d chained symlinks: %s", maxSymlinks, err)
+	}
+
+	if _, _, err = v.Lookup("chain"+strconv.Itoa(maxSymlinks), FollowLast); err == nil {
+		t.Fatalf("expected ELOOP for %d chained symlinks", maxSymlinks+1)
+	}
+}
+
+func TestSymlinkedDir(t *testing.T) {
+	s := newFakeServer(t)
+	s.file("d/f", "data")
+	s.symlink("dl", "d")
+	s.symlink("fl", "d/f")
+
+	v := s.target()
+	for _, c := range []struct {
+		name string
+		call func() error
+	}{
+		{"Mkdir", func() error { _, err := v.Mkdir("dl/sub", 0755); return err }},
+		{"Create", func() error { _, err := v.Create("dl/g", 0644); return err }},
+		{"Mknod", func() error { _, err := v.Mknod("dl/fifo", os.ModeNamedPipe|0600, 0); return err }},
+		{"Chmod", func() error { return v.Chmod("dl/f", 0600) }},
+		{"Rename", func() error { return v.Rename("dl/g", "dl/h") }},
+		{"Remove", func() error { return v.Remove("dl/h") }},
+		{"RmDir", func() error { return v.RmDir("dl/sub") }},
+		{"OpenDir", func() error {
+			d, err := v.OpenDir("dl")
+			if err == nil {
+				_, err = d.Next()
+			}
+			return err
+		}},
+		{"ReadDir", func() error { _, err := v.ReadDir("dl"); return err }},
+		{"ReadDirPlus", func() error { _, err := v.ReadDirPlus("dl"); return err }},
+		{"Open", func() error {
+			f, err := v.Open("fl")
+			if err == nil {
+				_, err = f.Read(make([]byte, 4))
+			}
+			return err
+		}},
+	} {
+		if err := c.call(); err != nil {
+			t.Errorf("%s through a symlink: %s", c.name, err)
+		}
+	}
+
+	if fi, err := v.Stat("d/f"); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("chmod through a symlink: %v, %v", fi, err)
+	}
+}
+
+func TestMknod(t *testing.T) {
+	s := newFakeServer(t)
+
+	v := s.target()
+	dev := Mkdev(259, 65537)
+	if Major(dev) != 259 || Minor(dev) != 65537 {
+		t.Fatalf("device number does not round-trip: %d, %d", Major(dev), Minor(dev))
+	}
+
+	if _, err := v.Mknod("tty", os.ModeDevice|os.ModeCharDevice|0620, dev); err != nil {
+		t.Fatalf("mknod: %s", err)
+	}
+
+	fi, err := v.Stat("tty")
+	if err != nil || fi.Mode() != os.ModeDevice|os.ModeCharDevice|0620 {
+		t.Fatalf("stat of a character device: %v, %v", fi, err)
+	}
+
+	if spec := fi.Sys().(*Fattr).SpecData; spec != [2]uint32{259, 65537} {
+		t.Fatalf("expected device 259, 65537, got %v", spec)
+	}
+
+	if _, err = v.Mknod("fifo", os.ModeNamedPipe|0600, 0); err != nil {
+		t.Fatalf("mknod: %s", err)
+	}
+
+	if fi, err = v.Stat("fifo"); err != nil || fi.Mode()&os.ModeNamedPipe == 0 {
+		t.Fatalf("stat of a FIFO: %v, %v", fi, err)
+	}
+
+	if _, err = v.Mknod("fifo", os.ModeNamedPipe|0600, 0); err != os.ErrExist {
+		t.Fatalf("mknod over an existing name: expected os.ErrExist, got %v", err)
+	}
+
+	// regular files are made with Create
+	_, err = v.Mknod("file", 0644, 0)
+	if perr, ok := err.(*os.PathError); !ok || perr.Err != os.ErrInvalid {
+		t.Fatalf("mknod of a regular file: expected os.ErrInvalid, got %v", err)
+	}
+}
+
+func TestAccess(t *testing.T) {
+	s := newFakeServer(t)
+	s.file("ro/f", "")
+	s.file("rw/x", "")
+
+	v := s.target()
+	v.Chmod("ro/f", 0400)
+	v.Chmod("ro", 0500)
+	v.Chmod("rw/x", 0700)
+
+	if granted, err := v.Access("ro/f", Access3Read|Access3Modify); err != nil || granted != Access3Read {
+		t.Fatalf("access: expected %x, got %x, %v", Access3Read, granted, err)
+	}
+
+	for _, c := range []struct {
+		name string
+		can  func(string) (bool, error)
+		p    string
+		want bool
+	}{
+		{"CanRead", v.CanRead, "ro/f", true},
+		{"CanWrite", v.CanWrite, "ro/f", false},
+		{"CanWrite", v.CanWrite, "rw/x", true},
+		{"CanExecute", v.CanExecute, "ro/f", false},
+		{"CanExecute", v.CanExecute, "rw/x", true},
+		{"CanExecute", v.CanExecute, "ro", true},
+		{"CanDelete", v.CanDelete, "ro/f", false},
+		{"CanDelete", v.CanDelete, "rw/x", true},
+	} {
+		if got, err := c.can(c.p); err != nil || got != c.want {
+			t.Errorf("%s(%s): expected %v, got %v, %v", c.name, c.p, c.want, got, err)
+		}
+	}
+
+	if _, err := v.CanRead("missing"); !os.IsNotExist(err) {
+		t.Fatalf("access of a missing file: expected not exist, got %v", err)
+	}
+}
+
+func TestStatFSAndPathConf(t *testing.T) {
+	s := newFakeServer(t)
+	s.file("d/f", "")
+
+	v := s.target()
+	fsstat, err := v.StatFS("d/f")
+	if err != nil {
+		t.Fatalf("statfs: %s", err)
+	}
+
+	if fsstat.TBytes != 1<<40 || fsstat.ABytes != 1<<29 || fsstat.FFiles == 0 {
+		t.Fatalf("unexpected fsstat: %+v", fsstat)
+	}
+
+	pathconf, err := v.PathConf("d")
+	if err != nil {
+		t.Fatalf("pathconf: %s", err)
+	}
+
+	if pathconf.NameMax != 255 || !pathconf.NoTrunc || pathconf.CaseInsensitive {
+		t.Fatalf("unexpected pathconf: %+v", pathconf)
+	}
+
+	if _, err = v.StatFS("missing"); !os.IsNotExist(err) {
+		t.Fatalf("statfs of a missing path: expected not exist, got %v", err)
+	}
+
+	if _, err = v.PathConf("missing"); !os.IsNotExist(err) {
+		t.Fatalf("pathconf of a missing path: expected not exist, got %v", err)
+	}
+}
+
+func TestReconnectProcs(t *testing.T) {
+	s := newFakeServer(t)
+	s.file("f", "data")
+	s.file("g", "")
+
+	v := s.target()
+	_, fh, err := v.Lookup("f")
+	if err != nil {
+		t.Fatalf("lookup: %s", err)
+	}
+
+	f, err := v.OpenFile("f", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	defer f.Close()
+
+	for _, c := range []struct {
+		name  string
+		proc  uint32
+		call  func() error
+		retry bool
+	}{
+		{"LOOKUP", NFSProc3Lookup, func() error { _, _, err := v.Lookup("f"); return err }, true},
+		{"GETATTR", NFSProc3GetAttr, func() error { _, err := v.StatFH(fh); return err }, true},
+		{"WRITE", NFSProc3Write, func() error { _, err := f.WriteAt([]byte("x"), 0); return err }, true},
+		{"REMOVE", NFSProc3Remove, func() error { return v.Remove("g") }, false},
+		{"CREATE", NFSProc3Create, func() error { _, err := v.Create("h", 0644); return err }, false},
+	} {
+		// the connection is closed on the first call of the procedure
+		s.mu.Lock()
+		h := s.handlers[c.proc]
+		dropped := false
+		s.handlers[c.proc] = func(args io.Reader) []byte {
+			s.mu.Lock()
+			drop := !dropped
+			dropped = true
+			s.mu.Unlock()
+
+			if drop {
+				return nil
+			}
+
+			return h(args)
+		}
+		s.mu.Unlock()
+
+		err := c.call()
+
+		s.mu.Lock()
+		s.handlers[c.proc] = h
+		s.mu.Unlock()
+
+		var lost *rpc.ConnectionLostError
+		if c.retry && err != nil {
+			t.Errorf("%s across a lost connection: %s", c.name, err)
+		} else if !c.retry && !errors.As(err, &lost) {
+			t.Errorf("%s across a lost connection: expected a ConnectionLostError, got %v", c.name, err)
+		}
+	}
+}
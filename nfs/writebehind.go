@@ -0,0 +1,215 @@
+// Copyright © 2017 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: BSD-2-Clause
+package nfs
+
+import (
+	"context"
+	"sync"
+)
+
+// writeBehind coalesces Writes into WRITEs of WTPref bytes, and sends them
+// without waiting for the replies, up to a memory budget
+type writeBehind struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	// data not sent yet, to be written at off
+	buf []byte
+	off uint64
+
+	// bytes in flight may not exceed budget
+	inFlight, budget int
+
+	// the end of each WRITE in flight, by offset.  A WRITE is not sent while
+	// another one overlapping it is in flight, as the server may carry them
+	// out in any order.
+	sending map[uint64]uint64
+
+	// first error of a WRITE, returned by every Write and flush after it
+	err error
+}
+
+// SetWriteBehind turns on buffering of Writes.  Writes are coalesced into
+// WRITEs of WTPref bytes, which are sent without waiting for the previous
+// ones, as long as no more than budget bytes are in flight.  A Write returns
+// as soon as its data is buffered, so the first error of a WRITE is returned
+// by a later Write, or by Sync or Close.  Reads, Stat, Truncate and Sync wait
+// for the buffered data to be written first.  Data written over a range
+// whose WRITE is still in flight is only sent once that WRITE is done, so
+// that the last Write wins.
+//
+// The WRITEs sent behind are bound by the context of the call that sent them,
+// WriteContext or the call that flushed the buffer, and a canceled WRITE
+// fails the file like any other.  Waiting for the budget or for the WRITEs in
+// flight stops once the context of the waiting call is done.  A budget of 0
+// turns write-behind off, after writing what is buffered.
+func (f *File) SetWriteBehind(budget int) error {
+	err := f.flushWrites(context.Background())
+
+	if budget <= 0 {
+		f.wb = nil
+		return err
+	}
+
+	f.wb = newWriteBehind(f, budget)
+	f.wb.err = err
+
+	return err
+}
+
+// newWriteBehind returns a writeBehind for f with room for at least one WRITE
+func newWriteBehind(f *File, budget int) *writeBehind {
+	if size := int(f.writeSize()); budget < size {
+		budget = size
+	}
+
+	wb := &writeBehind{budget: budget, sending: make(map[uint64]uint64)}
+	wb.cond = sync.NewCond(&wb.mu)
+
+	return wb
+}
+
+// write buffers p to be written at offset, and returns how much of p was
+// buffered
+func (wb *writeBehind) write(ctx context.Context, f *File, p []byte, offset uint64) (int, error) {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+
+	if wb.err != nil {
+		return 0, wb.err
+	}
+
+	// not contiguous with the buffered data, which is sent as is
+	if len(wb.buf) > 0 && wb.off+uint64(len(wb.buf)) != offset {
+		if err := wb.send(ctx, f); err != nil {
+			return 0, err
+		}
+	}
+
+	if len(wb.buf) == 0 {
+		wb.off = offset
+	}
+
+	size := int(f.writeSize())
+	for n := 0; n < len(p); {
+		// left full by a send that gave up
+		if len(wb.buf) == size {
+			if err := wb.send(ctx, f); err != nil {
+				return n, err
+			}
+		}
+
+		m := minInt(size-len(wb.buf), len(p)-n)
+		wb.buf = append(wb.buf, p[n:n+m]...)
+		n += m
+
+		if len(wb.buf) == size {
+			if err := wb.send(ctx, f); err != nil {
+				return n, err
+			}
+		}
+	}
+
+	return len(p), nil
+}
+
+// send writes the buffered data in the background with ctx, once the budget
+// allows and the WRITEs in flight to the same range are done.  If ctx is done
+// first, the data stays buffered.
+func (wb *writeBehind) send(ctx context.Context, f *File) error {
+	buf, off := wb.buf, wb.off
+	end := off + uint64(len(buf))
+
+	// counted at once, so that a concurrent flush waits for it too
+	wb.inFlight += len(buf)
+
+	stop := wb.wakeOn(ctx)
+	defer stop()
+
+	for wb.inFlight > wb.budget && wb.inFlight > len(buf) || wb.overlaps(off, end) {
+		if err := ctx.Err(); err != nil {
+			wb.inFlight -= len(buf)
+			return err
+		}
+
+		wb.cond.Wait()
+	}
+
+	wb.buf = nil
+	wb.off = end
+	wb.sending[off] = end
+
+	go func() {
+		_, err := f.writeAt(ctx, buf, off)
+
+		wb.mu.Lock()
+		defer wb.mu.Unlock()
+
+		if err != nil && wb.err == nil {
+			wb.err = err
+		}
+
+		wb.inFlight -= len(buf)
+		delete(wb.sending, off)
+		wb.cond.Broadcast()
+	}()
+
+	return nil
+}
+
+// overlaps reports whether a WRITE in flight overlaps [off, end)
+func (wb *writeBehind) overlaps(off, end uint64) bool {
+	for start, stop := range wb.sending {
+		if start < end && off < stop {
+			return true
+		}
+	}
+
+	return false
+}
+
+// flush sends the buffered data and waits for all WRITEs to complete, or for
+// ctx to be done
+func (wb *writeBehind) flush(ctx context.Context, f *File) error {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+
+	if len(wb.buf) > 0 {
+		if err := wb.send(ctx, f); err != nil {
+			return err
+		}
+	}
+
+	stop := wb.wakeOn(ctx)
+	defer stop()
+
+	for wb.inFlight > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		wb.cond.Wait()
+	}
+
+	return wb.err
+}
+
+// wakeOn wakes the goroutines waiting on wb.cond once ctx is done, so that
+// they can give up.  The returned stop function cancels that.
+func (wb *writeBehind) wakeOn(ctx context.Context) (stop func() bool) {
+	return context.AfterFunc(ctx, func() {
+		wb.mu.Lock()
+		defer wb.mu.Unlock()
+
+		wb.cond.Broadcast()
+	})
+}
+
+// flushWrites waits for the data written behind, if any
+func (f *File) flushWrites(ctx context.Context) error {
+	if f.wb == nil {
+		return nil
+	}
+
+	return f.wb.flush(ctx, f)
+}